@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseAge parses a duration that, in addition to the units supported by
+// time.ParseDuration, accepts days (d) and weeks (w) such as "14d" or "2w".
+func parseAge(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+
+	for suffix, unit := range units {
+		if value, ok := strings.CutSuffix(s, suffix); ok {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+
+	return time.ParseDuration(s)
+}
+
+// ageValue is a flag value for durations parsed with parseAge.
+type ageValue time.Duration
+
+func (a *ageValue) Set(s string) error {
+	d, err := parseAge(s)
+	if err != nil {
+		return err
+	}
+
+	*a = ageValue(d)
+	return nil
+}
+
+func (a *ageValue) String() string {
+	if *a == 0 {
+		return ""
+	}
+
+	return time.Duration(*a).String()
+}
+
+func (a *ageValue) Type() string {
+	return "duration"
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// completeGit returns a flag completion function that completes with the
+// lines output by the git command, run in the repository given by --cwd.
+func completeGit(args ...string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		gitArgs := args
+		if len(cwd) > 0 {
+			gitArgs = append([]string{"-C", cwd[0]}, args...)
+		}
+
+		git := opts.GitPath
+		if git == "" {
+			git = "git"
+		}
+
+		output, err := exec.Command(git, gitArgs...).Output()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+
+		var completions []string
+		for _, line := range strings.Split(string(output), "\n") {
+			if line != "" && strings.HasPrefix(line, toComplete) {
+				completions = append(completions, line)
+			}
+		}
+
+		return completions, cobra.ShellCompDirectiveNoFileComp
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// envPrefix is prepended to a flag's name to get the environment variable it
+// can be set with, e.g. GIT_CLEANUP_MAX_RETRIES for --max-retries.
+const envPrefix = "GIT_CLEANUP_"
+
+// mutuallyExclusive is the annotation cobra uses to record the groups of
+// mutually exclusive flags a flag belongs to.
+const mutuallyExclusive = "cobra_annotation_mutually_exclusive"
+
+// envAnnotation names the environment variable of a flag whose name doesn't
+// follow from the flag's name.
+const envAnnotation = "git_cleanup_env"
+
+// envName returns the environment variable for the flag.
+func envName(f *pflag.Flag) string {
+	if name := f.Annotations[envAnnotation]; len(name) > 0 {
+		return name[0]
+	}
+
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+}
+
+// applyEnv sets the flags that weren't given on the command line from their
+// environment variables. Lists are comma separated.
+func applyEnv(flags *pflag.FlagSet) error {
+	// A flag on the command line also overrides the environment variables of
+	// the flags it can't be used with
+	var groups []string
+	flags.Visit(func(f *pflag.Flag) {
+		groups = append(groups, f.Annotations[mutuallyExclusive]...)
+	})
+
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		value, ok := os.LookupEnv(envName(f))
+		if !ok || f.Changed || err != nil {
+			return
+		}
+
+		for _, group := range f.Annotations[mutuallyExclusive] {
+			if slices.Contains(groups, group) {
+				return
+			}
+		}
+
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			err = slice.Replace(strings.Split(value, ","))
+			f.Changed = true
+		} else {
+			err = flags.Set(f.Name, value)
+		}
+
+		if err != nil {
+			err = fmt.Errorf("%s: %w", envName(f), err)
+		}
+	})
+
+	return err
+}
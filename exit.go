@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mskelton/git-cleanup/pkg/cleanup"
+)
+
+// Exit codes, so scripts can tell a cleanup that partly failed from one that
+// couldn't run at all.
+const (
+	exitSuccess     = 0
+	exitPartial     = 1
+	exitError       = 2
+	exitInterrupted = 130
+)
+
+// exitCode returns the exit code for the error returned by the command. When
+// several repositories are cleaned up, the worst of their errors wins.
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return exitSuccess
+	case *cleanup.PartialError:
+		return exitPartial
+	case interface{ Unwrap() []error }:
+		code := exitSuccess
+		for _, err := range e.Unwrap() {
+			code = max(code, exitCode(err))
+		}
+
+		return code
+	case interface{ Unwrap() error }:
+		return exitCode(e.Unwrap())
+	}
+
+	return exitError
+}
+
+// errorRecord is an error printed with --json.
+type errorRecord struct {
+	Error string `json:"error"`
+	Phase string `json:"phase,omitempty"`
+}
+
+// printError prints the error to stderr, as a JSON object for each of the
+// errors it joins when --json is set.
+func printError(err error) {
+	if !jsonOut {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+
+	encoder := json.NewEncoder(os.Stderr)
+	for _, record := range errorRecords(err, "") {
+		_ = encoder.Encode(record)
+	}
+}
+
+// errorRecords splits the error into the errors it joins, keeping the context
+// they were wrapped with, such as the repository they happened in.
+func errorRecords(err error, prefix string) []errorRecord {
+	switch e := err.(type) {
+	case *cleanup.PhaseError:
+		return []errorRecord{{prefix + e.Error(), e.Phase}}
+	case interface{ Unwrap() []error }:
+		var records []errorRecord
+		for _, err := range e.Unwrap() {
+			records = append(records, errorRecords(err, prefix)...)
+		}
+
+		return records
+	case interface{ Unwrap() error }:
+		// Wrapping only adds a prefix to the message, e.g. the repository
+		if inner := e.Unwrap(); inner != nil && strings.HasSuffix(err.Error(), inner.Error()) {
+			return errorRecords(inner, prefix+strings.TrimSuffix(err.Error(), inner.Error()))
+		}
+	}
+
+	return []errorRecord{{Error: prefix + err.Error()}}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mskelton/git-cleanup/pkg/cleanup"
+)
+
+func TestErrorRecords(t *testing.T) {
+	signature := &cleanup.PhaseError{
+		Phase: cleanup.PhaseVerifySignature,
+		Err:   errors.New("main is at 3f78685 which doesn't have a valid signature (no signature), refusing to clean up"),
+	}
+	pull := &cleanup.PhaseError{Phase: cleanup.PhasePull, Err: errors.New("failed to pull main: exit code 1")}
+
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{
+			name: "signature",
+			err:  fmt.Errorf("/src/app: %w", signature),
+			want: []string{`{"error":"/src/app: main is at 3f78685 which doesn't have a valid signature (no signature), refusing to clean up","phase":"verify-signature"}`},
+		},
+		{
+			name: "partial",
+			err:  &cleanup.PartialError{Errs: []error{pull}},
+			want: []string{`{"error":"failed to pull main: exit code 1","phase":"pull"}`},
+		},
+		{
+			name: "without a phase",
+			err:  errors.New("not inside a git repository"),
+			want: []string{`{"error":"not inside a git repository"}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, record := range errorRecords(tt.err, "") {
+				data, err := json.Marshal(record)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got = append(got, string(data))
+			}
+
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("errorRecords() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
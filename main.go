@@ -1,36 +1,335 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/fatih/color"
+	"github.com/mskelton/git-cleanup/pkg/cleanup"
+	"github.com/mskelton/git-cleanup/pkg/streamer"
 	"github.com/spf13/cobra"
 )
 
+// colorModes are the values accepted by --color.
+var colorModes = []string{"auto", "always", "never"}
+
+// exitDelay is how long to wait for the cleanup to stop after being
+// interrupted before exiting anyway.
+const exitDelay = 2 * time.Second
+
 var (
-	cwd string
+	cwd       []string
+	opts      cleanup.Options
+	since     ageValue
+	maxAge    ageValue
+	eventsFd  int
+	poolOnly  bool
+	localOnly bool
+	noColor   bool
+	colorMode string
+	logLevel  string
+	jsonOut   bool
+
+	outputFilter   []string
+	noOutputFilter bool
 )
 
 func main() {
 	var rootCmd = &cobra.Command{
-		Use:   "git-cleanup",
+		Use:   "git-cleanup [path...]",
 		Short: "Clean up your git repositories",
 		Long: `Git Cleanup is a tool that helps maintain clean git repositories by:
 - Pulling latest changes from the default branch
 - Pruning local branches that have been removed on remote
 - Deleting local branches that no longer exist on remote
 - Removing worktrees for deleted branches
-- Auto-retrying git operations that fail due to ref locking issues`,
+- Auto-retrying git operations that fail due to ref locking issues
+
+Exit codes:
+  0    the cleanup succeeded, or there was nothing to clean up
+  1    the cleanup ran, but some of its operations failed
+  2    the cleanup couldn't run, such as outside of a git repository
+  130  the cleanup was interrupted`,
 		Version: "1.0.0",
+		// Errors are printed below, without the usage output burying them
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		Args:          cobra.ArbitraryArgs,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyEnv(cmd.Flags()); err != nil {
+				return err
+			}
+
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+				return fmt.Errorf("invalid log level %q, use error, info, or debug", logLevel)
+			}
+
+			slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+			// Color is already disabled when NO_COLOR is set or stdout isn't a
+			// terminal, which also applies to the spinner
+			if noColor {
+				colorMode = "never"
+			}
+
+			switch colorMode {
+			case "auto":
+			case "always":
+				color.NoColor = false
+			case "never":
+				color.NoColor = true
+			default:
+				return fmt.Errorf("invalid color mode %q, use one of %s", colorMode, strings.Join(colorModes, ", "))
+			}
+
+			if noOutputFilter {
+				streamer.OutputFilter = nil
+			}
+
+			for _, pattern := range outputFilter {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return fmt.Errorf("invalid output filter %q: %w", pattern, err)
+				}
+
+				streamer.OutputFilter = append(slices.Clip(streamer.OutputFilter), re)
+			}
+
+			// Keep stderr for the JSON errors
+			if jsonOut {
+				streamer.ErrorOutput = os.Stdout
+			}
+
+			if eventsFd > 0 {
+				streamer.Events = os.NewFile(uintptr(eventsFd), "events")
+			}
+
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mode := cleanup.ModeFull
+			if poolOnly {
+				mode = cleanup.ModePool
+			} else if localOnly {
+				mode = cleanup.ModeLocal
+			}
+
+			return run(cmd, args, mode)
+		},
+	}
+
+	rootCmd.PersistentFlags().StringArrayVar(&cwd, "cwd", nil, "Run commands in this directory (repeatable)")
+	rootCmd.PersistentFlags().StringVar(&opts.Remote, "remote", "origin", "Remote to pull from and prune against")
+	rootCmd.PersistentFlags().StringVar(&opts.DefaultBranch, "default-branch", "", "Use this as the default branch instead of detecting it")
+	rootCmd.PersistentFlags().StringSliceVar(&opts.DetectOrder, "detect-order", nil, "Methods tried in order to detect the default branch ("+strings.Join(cleanup.DetectMethods, ", ")+")")
+	rootCmd.PersistentFlags().BoolVar(&opts.NoCache, "no-cache", false, "Detect the default branch instead of using the one cached by an earlier run")
+	rootCmd.PersistentFlags().BoolVar(&opts.ForgeDefault, "forge-default", false, "Ask GitHub or GitLab for the default branch when it can't be detected locally")
+	_ = rootCmd.RegisterFlagCompletionFunc("detect-order", cobra.FixedCompletions(cleanup.DetectMethods, cobra.ShellCompDirectiveNoFileComp))
+	rootCmd.PersistentFlags().StringVar(&opts.WorktreeBase, "worktree-base", "", "Reset and rebase worktrees onto this branch instead of the default branch")
+	rootCmd.PersistentFlags().StringVar(&opts.WorktreePrefix, "worktree-prefix", "web-", "Directory name prefix used to identify worktree pool branches")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.PoolBranches, "pool-branch", nil, "Branch of the worktree pool, whose worktree is created when it's missing (repeatable)")
+	rootCmd.PersistentFlags().IntVarP(&opts.Jobs, "jobs", "j", runtime.NumCPU(), "Number of branches to delete concurrently")
+	rootCmd.PersistentFlags().IntVar(&opts.MaxParallelWorktrees, "max-parallel-worktrees", 1, "Number of worktree pool branches to rebase concurrently")
+	rootCmd.PersistentFlags().IntVar(&opts.MaxRetries, "max-retries", 2, "Maximum number of times to retry git operations that fail due to ref locking")
+	rootCmd.PersistentFlags().DurationVar(&opts.RetryDelay, "retry-delay", 2*time.Second, "Initial delay between retries, doubled after each attempt")
+	rootCmd.PersistentFlags().StringVar(&opts.WorktreeDirtyPolicy, "worktree-dirty-policy", cleanup.DirtyStash, "What to do with uncommitted changes in the worktree pool before rebasing ("+strings.Join(cleanup.DirtyPolicies, ", ")+")")
+	_ = rootCmd.RegisterFlagCompletionFunc("worktree-dirty-policy", cobra.FixedCompletions(cleanup.DirtyPolicies, cobra.ShellCompDirectiveNoFileComp))
+	rootCmd.PersistentFlags().StringVar(&opts.OnError, "on-error", cleanup.OnErrorContinue, "What to do when part of the cleanup fails, continue with the rest or abort ("+strings.Join(cleanup.OnErrorPolicies, ", ")+")")
+	_ = rootCmd.RegisterFlagCompletionFunc("on-error", cobra.FixedCompletions(cleanup.OnErrorPolicies, cobra.ShellCompDirectiveNoFileComp))
+	rootCmd.PersistentFlags().StringVar(&opts.GitPath, "git-path", "", "Path to the git binary to run instead of git on the PATH")
+	_ = rootCmd.PersistentFlags().SetAnnotation("git-path", envAnnotation, []string{envPrefix + "GIT"})
+	rootCmd.PersistentFlags().DurationVar(&opts.Timeout, "timeout", 0, "Abort git operations that take longer than this (e.g. 60s)")
+	rootCmd.PersistentFlags().BoolVar(&opts.AllowPrompt, "allow-prompt", false, "Let git prompt for credentials instead of failing when they aren't cached")
+	rootCmd.PersistentFlags().BoolVar(&opts.Autostash, "autostash", false, "Stash uncommitted changes before switching to the default branch")
+	rootCmd.PersistentFlags().BoolVarP(&opts.Force, "force", "f", false, "Delete gone branches even if they have commits that were never merged")
+	rootCmd.PersistentFlags().BoolVar(&opts.PruneMerged, "prune-merged", false, "Also delete branches fully merged into the default branch, even if their remote branch still exists")
+	rootCmd.PersistentFlags().BoolVar(&opts.DeleteSquashed, "delete-squashed", false, "Also delete branches that were squash merged into the default branch")
+	rootCmd.PersistentFlags().Var(&since, "since", "Only delete branches whose last commit is older than this (e.g. 14d, 2w, 36h)")
+	rootCmd.PersistentFlags().Var(&maxAge, "max-branch-age", "Ask before deleting branches whose last commit is older than this, skipping them without a terminal (e.g. 180d, 52w)")
+	rootCmd.PersistentFlags().BoolVar(&opts.ExcludeCurrentWorktree, "exclude-current-worktree", true, "Don't reset or rebase the worktree git-cleanup is run from")
+	rootCmd.PersistentFlags().BoolVar(&opts.KeepCurrent, "keep-current", false, "Stay on the current branch instead of checking out the default branch")
+	rootCmd.PersistentFlags().BoolVar(&opts.PullRebase, "pull-rebase", false, "Rebase local commits on the default branch when pulling instead of merging")
+	rootCmd.PersistentFlags().BoolVar(&opts.FFOnly, "ff-only", true, "Only pull the default branch when it can be fast-forwarded")
+	rootCmd.PersistentFlags().BoolVar(&opts.NoPull, "no-pull", false, "Skip pulling the latest changes into the default branch")
+	rootCmd.PersistentFlags().BoolVar(&opts.NoFetch, "no-fetch", false, "Skip fetching from the remote, using the existing remote-tracking refs")
+	rootCmd.PersistentFlags().BoolVar(&opts.FetchAll, "fetch-all", false, "Fetch and prune every remote, not only the remotes local branches track")
+	rootCmd.PersistentFlags().BoolVar(&opts.RecurseSubmodules, "recurse-submodules", false, "Also prune and delete gone branches in each submodule")
+	rootCmd.PersistentFlags().BoolVar(&opts.VerifySignature, "verify-signature", false, "Refuse to clean up unless the default branch points to a commit with a valid signature")
+	rootCmd.PersistentFlags().BoolVar(&opts.Verify, "verify", false, "Check every branch meant to be deleted is gone afterwards")
+	rootCmd.PersistentFlags().BoolVarP(&opts.DryRun, "dry-run", "n", false, "Show what would be cleaned up without changing anything")
+	rootCmd.PersistentFlags().BoolVar(&opts.Explain, "explain", false, "Print the git commands that change the repository, or would with --dry-run")
+	rootCmd.PersistentFlags().StringVar(&opts.StashMessage, "stash-message", cleanup.DefaultStashMessage, "Message of stashes made before rebasing the worktree pool, with {branch} and {base} placeholders")
+	rootCmd.PersistentFlags().BoolVar(&opts.RecoverStashes, "recover-stashes", false, "Restore worktree pool stashes left behind by an interrupted cleanup")
+	rootCmd.PersistentFlags().BoolVar(&opts.PruneRemoteTracking, "prune-remote-tracking", false, "Also remove remote-tracking refs that no longer exist on the remote with git remote prune")
+	rootCmd.PersistentFlags().BoolVar(&opts.PruneEmptyWorktreeDirs, "prune-empty-worktree-dirs", false, "Remove empty worktree pool directories left behind by worktrees that no longer exist")
+	rootCmd.PersistentFlags().BoolVar(&opts.PruneTags, "prune-tags", false, "Delete local tags that have been deleted from the remote")
+	rootCmd.PersistentFlags().BoolVarP(&opts.Interactive, "interactive", "i", false, "Confirm each worktree reset and branch deletion before it happens")
+	rootCmd.PersistentFlags().BoolVar(&streamer.Verbose, "verbose", false, "Show the full output of every git command and how long each step took")
+	rootCmd.PersistentFlags().BoolVarP(&streamer.Quiet, "quiet", "q", false, "Only print operations that fail")
+	rootCmd.MarkFlagsMutuallyExclusive("verbose", "quiet")
+	rootCmd.PersistentFlags().IntVar(&streamer.OutputLines, "output-lines", streamer.DefaultOutputLines, "Number of output lines to show while an operation runs (0 shows only the spinner)")
+	rootCmd.PersistentFlags().Var(&streamer.Progress, "progress", "How to show operations with many steps, a spinner for each step or a single progress bar (spinner, bar)")
+	rootCmd.PersistentFlags().Var(&streamer.SpinnerStyle, "spinner-style", "Spinner to show while an operation runs, by index or name (arrows, circle, line, braille, dots)")
+	rootCmd.PersistentFlags().DurationVar(&streamer.SpinnerInterval, "spinner-interval", streamer.DefaultSpinnerInterval, "How often the spinner is redrawn")
+	rootCmd.PersistentFlags().StringArrayVar(&outputFilter, "output-filter", nil, "Hide lines of git output matching this regex, on top of git's progress lines")
+	rootCmd.PersistentFlags().BoolVar(&noOutputFilter, "no-output-filter", false, "Show git's progress lines instead of hiding them")
+	rootCmd.PersistentFlags().BoolVar(&streamer.NoSpinner, "no-spinner", false, "Print a static line for each operation instead of a spinner")
+	rootCmd.PersistentFlags().StringVar(&opts.ReportFile, "report-file", "", "Append a JSON line describing each run to this file")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "error", "Log internal details to stderr at this level (error, info, debug)")
+	rootCmd.PersistentFlags().StringVar(&colorMode, "color", "auto", "When to color the output, auto colors it when writing to a terminal and NO_COLOR isn't set (auto, always, never)")
+	rootCmd.PersistentFlags().BoolVar(&noColor, "no-color", false, "Disable colored output")
+	_ = rootCmd.PersistentFlags().MarkDeprecated("no-color", "use --color=never instead")
+	_ = rootCmd.RegisterFlagCompletionFunc("color", cobra.FixedCompletions(colorModes, cobra.ShellCompDirectiveNoFileComp))
+	rootCmd.MarkFlagsMutuallyExclusive("color", "no-color")
+	rootCmd.PersistentFlags().BoolVar(&jsonOut, "json", false, "Print errors to stderr as JSON, one object per line with the error and the phase it happened in")
+	rootCmd.PersistentFlags().IntVar(&eventsFd, "events-fd", 0, "Write newline-delimited JSON progress events to this file descriptor")
+	_ = rootCmd.RegisterFlagCompletionFunc("remote", completeGit("remote"))
+	_ = rootCmd.RegisterFlagCompletionFunc("default-branch", completeGit("for-each-ref", "--format=%(refname:short)", "refs/heads"))
+	_ = rootCmd.RegisterFlagCompletionFunc("worktree-base", completeGit("for-each-ref", "--format=%(refname:short)", "refs/heads"))
+	rootCmd.PersistentFlags().StringSliceVar(&opts.Only, "only", nil, "Only run these phases ("+strings.Join(cleanup.Phases, ", ")+")")
+	rootCmd.PersistentFlags().StringSliceVar(&opts.Skip, "skip", nil, "Skip these phases")
+	_ = rootCmd.RegisterFlagCompletionFunc("progress", cobra.FixedCompletions(streamer.ProgressModes, cobra.ShellCompDirectiveNoFileComp))
+	_ = rootCmd.RegisterFlagCompletionFunc("only", cobra.FixedCompletions(cleanup.Phases, cobra.ShellCompDirectiveNoFileComp))
+	_ = rootCmd.RegisterFlagCompletionFunc("skip", cobra.FixedCompletions(cleanup.Phases, cobra.ShellCompDirectiveNoFileComp))
+	rootCmd.PersistentFlags().StringArrayVar(&opts.AllowHosts, "allow-host", nil, "Only fetch and pull from remotes on this host, refusing any others (repeatable)")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.Protect, "protect", nil, "Never delete branches matching this glob pattern (repeatable)")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.Include, "include", nil, "Only delete branches matching this glob pattern (repeatable)")
+	rootCmd.Flags().StringVar(&opts.PostHook, "post-hook", "", "Shell command to run in the repository after a successful cleanup")
+	rootCmd.Flags().BoolVar(&poolOnly, "prune-worktrees-only", false, "Only pull and rebase the worktree pool, without deleting branches or resetting worktrees")
+	rootCmd.Flags().BoolVar(&localOnly, "prune-local-only", false, "Only delete local branches without an upstream that are fully merged into the default branch")
+	rootCmd.MarkFlagsMutuallyExclusive("prune-worktrees-only", "prune-local-only")
+
+	worktreesCmd := &cobra.Command{
+		Use:   "worktrees [path...]",
+		Short: "Reset worktrees of deleted branches and rebase the worktree pool",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return cleanup()
+			return run(cmd, args, cleanup.ModeWorktrees)
 		},
 	}
 
-	rootCmd.Flags().StringVar(&cwd, "cwd", "", "Run commands in this directory")
+	branchesCmd := &cobra.Command{
+		Use:   "branches [path...]",
+		Short: "Prune and delete branches that no longer exist on remote",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, cleanup.ModeBranches)
+		},
+	}
 
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	restoreCmd := &cobra.Command{
+		Use:   "restore [branch]",
+		Short: "Restore a branch deleted by git-cleanup",
+		Long: `Restore a branch deleted by git-cleanup at the commit it pointed to when it
+was deleted. Without a branch, lists the deleted branches that can be restored.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var dir, branch string
+			if len(cwd) > 0 {
+				dir = cwd[0]
+			}
+
+			if len(args) > 0 {
+				branch = args[0]
+			}
+
+			return cleanup.Restore(dir, branch, flagOptions(cmd))
+		},
 	}
+
+	defaultBranchCmd := &cobra.Command{
+		Use:   "default-branch",
+		Short: "Print the default branch of the repository",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var dir string
+			if len(cwd) > 0 {
+				dir = cwd[0]
+			}
+
+			branch, err := cleanup.DefaultBranch(dir, flagOptions(cmd))
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(branch)
+			return nil
+		},
+	}
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "List how each branch would be cleaned up, without changing anything",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var dir string
+			if len(cwd) > 0 {
+				dir = cwd[0]
+			}
+
+			return cleanup.Status(dir, flagOptions(cmd))
+		},
+	}
+
+	rootCmd.AddCommand(worktreesCmd, branchesCmd, restoreCmd, defaultBranchCmd, statusCmd)
+
+	ctx := handleSignals()
+	err := rootCmd.ExecuteContext(ctx)
+	if ctx.Err() != nil {
+		os.Exit(exitInterrupted)
+	}
+
+	if err != nil {
+		printError(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// run cleans up the repositories given as arguments using the options from
+// the command line flags.
+func run(cmd *cobra.Command, args []string, mode cleanup.Mode) error {
+	opts := flagOptions(cmd)
+	opts.Dirs = append(cwd, args...)
+	opts.Mode = mode
+
+	_, err := cleanup.RunContext(cmd.Context(), opts)
+	return err
+}
+
+// handleSignals returns a context that is canceled when interrupted, which
+// stops any running git commands and the rest of the cleanup.
+func handleSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		cancel()
+		streamer.Stop()
+
+		// The cleanup exits once it notices it was canceled, but it can't when
+		// waiting for a prompt to be answered
+		time.Sleep(exitDelay)
+		os.Exit(exitInterrupted)
+	}()
+
+	return ctx
+}
+
+// flagOptions returns the options set by the command line flags.
+func flagOptions(cmd *cobra.Command) cleanup.Options {
+	opts.Since = time.Duration(since)
+	opts.MaxBranchAge = time.Duration(maxAge)
+	opts.Changed = cmd.Flags().Changed
+	return opts
 }
@@ -0,0 +1,141 @@
+package cleanup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const backupLogName = "cleanup-deleted-refs.log"
+
+// backup is a branch recorded in the backup log before it was deleted.
+type backup struct {
+	Time   time.Time
+	SHA    string
+	Branch string
+}
+
+func (r *repo) backupLogPath() (string, error) {
+	return r.gitPath(backupLogName)
+}
+
+// backupBranch records the branch's current commit in the backup log so it
+// can be restored after being deleted.
+func (r *repo) backupBranch(branch string) error {
+	if r.opts.DryRun {
+		return nil
+	}
+
+	output, err := r.runner.Run("rev-parse", "refs/heads/"+branch)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", branch, err)
+	}
+
+	path, err := r.backupLogPath()
+	if err != nil {
+		return err
+	}
+
+	// Branches may be deleted concurrently, so serialize writes to the log
+	r.backupMu.Lock()
+	defer r.backupMu.Unlock()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sha := strings.TrimSpace(string(output))
+	_, err = fmt.Fprintf(file, "%s\t%s\t%s\n", time.Now().Format(time.RFC3339), sha, branch)
+	return err
+}
+
+func readBackups(path string) ([]backup, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var backups []backup
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, backup{Time: t, SHA: fields[1], Branch: fields[2]})
+	}
+
+	return backups, scanner.Err()
+}
+
+// Restore recreates a deleted branch at the commit it pointed to when it was
+// deleted. Without a branch, the deleted branches that can be restored are
+// listed instead.
+func Restore(dir, branch string, opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	rootDir, err := getRootDir(opts.runnerIn(dir), dir)
+	if err != nil {
+		return err
+	}
+
+	r := newRepo(rootDir, Options{GitPath: opts.GitPath, Git: opts.Git})
+	path, err := r.backupLogPath()
+	if err != nil {
+		return err
+	}
+
+	backups, err := readBackups(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if branch == "" {
+		if len(backups) == 0 {
+			fmt.Println("No deleted branches to restore")
+		}
+
+		// Show the most recently deleted branches first
+		for i := len(backups) - 1; i >= 0; i-- {
+			b := backups[i]
+			fmt.Printf("%s %s %s\n", color.BlackString(b.Time.Format(time.DateTime)), color.YellowString(b.SHA[:min(len(b.SHA), 7)]), b.Branch)
+		}
+
+		return nil
+	}
+
+	// Restore the most recent deletion of the branch
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].Branch != branch {
+			continue
+		}
+
+		output, err := r.combinedOutput(r.git("branch", branch, backups[i].SHA))
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %s", branch, strings.TrimSpace(string(output)))
+		}
+
+		color.Green("✔ Restored %s at %s", branch, backups[i].SHA)
+		return nil
+	}
+
+	return fmt.Errorf("no deleted branch named %s was found in %s", branch, path)
+}
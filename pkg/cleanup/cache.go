@@ -0,0 +1,122 @@
+package cleanup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cacheName is the file in the git directory caching the detected default
+// branch of each remote, one tab separated remote URL, remote HEAD and branch
+// per line.
+const cacheName = "git-cleanup-cache"
+
+// cacheEntry is the default branch detected for a remote, which is stale once
+// the remote's HEAD points somewhere else.
+type cacheEntry struct {
+	URL    string
+	Head   string
+	Branch string
+}
+
+// cachedDefaultBranch returns the default branch detected by an earlier run,
+// detecting it with detect and caching it when there is none. Only the branch
+// the remote's HEAD points to is cached, as nothing tells when a branch
+// detected any other way is stale.
+func (r *repo) cachedDefaultBranch(detect func() (string, error)) (string, error) {
+	// Choosing how to detect the branch would be ignored by a cached one
+	if r.opts.NoCache || len(r.opts.DetectOrder) > 0 || r.opts.ForgeDefault {
+		return detect()
+	}
+
+	path, err := r.gitPath(cacheName)
+	if err != nil {
+		return detect()
+	}
+
+	url, head := r.cacheKey()
+	if url == "" || head == "" {
+		return detect()
+	}
+
+	entries, err := readCache(path)
+	if err != nil {
+		slog.Debug("ignoring unreadable default branch cache", "path", path, "error", err)
+	}
+
+	for _, entry := range entries {
+		if entry.URL == url && entry.Head == head {
+			slog.Debug("using cached default branch", "branch", entry.Branch, "url", url)
+			return entry.Branch, nil
+		}
+	}
+
+	branch, err := detect()
+	if err != nil || r.opts.DryRun {
+		return branch, err
+	}
+
+	// Replace the stale entry for the remote, if any
+	cached := []cacheEntry{{url, head, branch}}
+	for _, entry := range entries {
+		if entry.URL != url {
+			cached = append(cached, entry)
+		}
+	}
+
+	if err := writeCache(path, cached); err != nil {
+		slog.Debug("failed to write default branch cache", "path", path, "error", err)
+	}
+
+	return branch, nil
+}
+
+// cacheKey returns the URL of the remote and what its HEAD points to, read
+// from the ref file to avoid running git.
+func (r *repo) cacheKey() (url, head string) {
+	output, err := r.runner.Run("config", "--get", "remote."+r.opts.Remote+".url")
+	if err != nil {
+		return "", ""
+	}
+
+	if path, err := r.gitPath(filepath.Join("refs", "remotes", r.opts.Remote, "HEAD")); err == nil {
+		if data, err := os.ReadFile(path); err == nil {
+			head = strings.TrimSpace(string(data))
+		}
+	}
+
+	return strings.TrimSpace(string(output)), head
+}
+
+func readCache(path string) ([]cacheEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []cacheEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Split(scanner.Text(), "\t"); len(fields) == 3 {
+			entries = append(entries, cacheEntry{fields[0], fields[1], fields[2]})
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func writeCache(path string, entries []cacheEntry) error {
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s\t%s\t%s\n", entry.URL, entry.Head, entry.Branch)
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
@@ -0,0 +1,114 @@
+package cleanup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCachedDefaultBranch(t *testing.T) {
+	const url = "git@github.com:owner/repo.git"
+	const head = "ref: refs/remotes/origin/main"
+
+	tests := []struct {
+		name      string
+		opts      Options
+		head      string
+		cached    string
+		want      string
+		wantCache string
+	}{
+		{
+			name:      "cached",
+			head:      head,
+			cached:    url + "\t" + head + "\tcached\n",
+			want:      "cached",
+			wantCache: url + "\t" + head + "\tcached\n",
+		},
+		{
+			name:      "remote HEAD moved",
+			head:      head,
+			cached:    url + "\tref: refs/remotes/origin/master\tmaster\n",
+			want:      "main",
+			wantCache: url + "\t" + head + "\tmain\n",
+		},
+		{
+			name:      "no cache",
+			opts:      Options{NoCache: true},
+			head:      head,
+			cached:    url + "\t" + head + "\tcached\n",
+			want:      "main",
+			wantCache: url + "\t" + head + "\tcached\n",
+		},
+		{
+			name:      "detect order",
+			opts:      Options{DetectOrder: []string{"config"}},
+			head:      head,
+			cached:    url + "\t" + head + "\tcached\n",
+			want:      "trunk",
+			wantCache: url + "\t" + head + "\tcached\n",
+		},
+		{
+			name:      "forge default",
+			opts:      Options{ForgeDefault: true},
+			head:      head,
+			cached:    url + "\t" + head + "\tcached\n",
+			want:      "main",
+			wantCache: url + "\t" + head + "\tcached\n",
+		},
+		{
+			name:      "no remote HEAD",
+			cached:    url + "\t\tcached\n",
+			want:      "trunk",
+			wantCache: url + "\t\tcached\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitDir := t.TempDir()
+			cachePath := filepath.Join(gitDir, cacheName)
+			if err := os.WriteFile(cachePath, []byte(tt.cached), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.head != "" {
+				headPath := filepath.Join(gitDir, "refs", "remotes", "origin", "HEAD")
+				if err := os.MkdirAll(filepath.Dir(headPath), 0o755); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.WriteFile(headPath, []byte(tt.head+"\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			git := fakeGit{
+				"rev-parse --git-common-dir":      gitDir + "\n",
+				"config --get remote.origin.url":  url + "\n",
+				"config --get init.defaultBranch": "trunk\n",
+			}
+			if tt.head != "" {
+				git["symbolic-ref refs/remotes/origin/HEAD"] = "refs/remotes/origin/main\n"
+			}
+
+			opts := tt.opts
+			opts.Remote = "origin"
+			opts.Git = git
+
+			r := newRepo("/src/app", opts)
+			got, err := r.cachedDefaultBranch(r.getDefaultBranch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("cachedDefaultBranch() = %q, want %q", got, tt.want)
+			}
+
+			if cache, _ := os.ReadFile(cachePath); string(cache) != tt.wantCache {
+				t.Errorf("cache = %q, want %q", cache, tt.wantCache)
+			}
+		})
+	}
+}
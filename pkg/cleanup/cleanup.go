@@ -0,0 +1,1806 @@
+package cleanup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/mskelton/git-cleanup/pkg/streamer"
+	"golang.org/x/term"
+)
+
+// repo is a repository being cleaned up, along with the options to clean it
+// with.
+type repo struct {
+	dir  string
+	opts Options
+	// ctx stops the git commands run in the repo once it is done
+	ctx context.Context
+	// currentWorktree is the linked worktree git-cleanup was run from, if any
+	currentWorktree string
+
+	// State shared between the phases of a cleanup
+	defaultBranch string
+	// worktreeBase is what worktrees are reset and rebased onto
+	worktreeBase  string
+	currentBranch string
+	branches      branchInfo
+	result        Summary
+	errs          []error
+
+	// runner runs the git commands used to inspect the repo
+	runner GitRunner
+
+	backupMu sync.Mutex
+
+	// rand jitters retry delays, guarded by randMu as commands are retried
+	// concurrently
+	rand   *rand.Rand
+	randMu sync.Mutex
+
+	// explained are the commands that changed the repo, or would have in a dry
+	// run, printed when explaining the cleanup
+	explained []string
+	explainMu sync.Mutex
+
+	// gitDir is the common git directory, looked up once by gitPath
+	gitDir     string
+	gitDirErr  error
+	gitDirOnce sync.Once
+
+	// stashMu guards the stash list, which is shared by every worktree
+	stashMu sync.Mutex
+
+	// planMu guards the rebase plans, as the worktree pool is rebased
+	// concurrently
+	planMu sync.Mutex
+}
+
+// PartialError is returned when a cleanup ran, but some of its operations
+// failed.
+type PartialError struct {
+	Errs []error
+}
+
+func (e *PartialError) Error() string {
+	return errors.Join(e.Errs...).Error()
+}
+
+func (e *PartialError) Unwrap() []error {
+	return e.Errs
+}
+
+// Result is what a cleanup did to each of the repositories.
+type Result struct {
+	Repos []Summary
+}
+
+// Run cleans up each of the repositories in the options.
+func Run(opts Options) (Result, error) {
+	return RunContext(context.Background(), opts)
+}
+
+// RunContext is like Run, but stops any git commands that are running once the
+// context is done.
+func RunContext(ctx context.Context, opts Options) (Result, error) {
+	var result Result
+
+	if opts.Interactive && !term.IsTerminal(int(os.Stdin.Fd())) {
+		return result, errors.New("--interactive requires a terminal to prompt for confirmation")
+	}
+
+	if err := opts.validate(); err != nil {
+		return result, err
+	}
+
+	run := map[Mode]func(*repo) error{
+		ModeFull:      (*repo).cleanup,
+		ModeWorktrees: (*repo).cleanupWorktrees,
+		ModeBranches:  (*repo).cleanupBranches,
+		ModePool:      (*repo).cleanupPool,
+		ModeLocal:     (*repo).cleanupLocal,
+	}[opts.Mode]
+	if run == nil {
+		return result, fmt.Errorf("unknown mode %d", opts.Mode)
+	}
+
+	// Without any directories, clean the repo in the working directory
+	dirs := opts.Dirs
+	if len(dirs) == 0 {
+		dirs = []string{""}
+	}
+
+	var errs []error
+	for i, dir := range dirs {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		if len(dirs) > 1 && !streamer.Quiet {
+			if i > 0 {
+				fmt.Println()
+			}
+
+			color.New(color.Bold).Println(dir)
+		}
+
+		summary, err := cleanupRepo(ctx, dir, opts, run)
+		if summary != nil {
+			result.Repos = append(result.Repos, *summary)
+		}
+
+		if err != nil {
+			if len(opts.Dirs) > 0 {
+				err = fmt.Errorf("%s: %w", dir, err)
+			}
+
+			errs = append(errs, err)
+		}
+
+		if opts.RecurseSubmodules && summary != nil {
+			summaries, err := cleanupSubmodules(ctx, summary.Dir, opts)
+			result.Repos = append(result.Repos, summaries...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// cleanupRepo runs the phases against the repo in dir, returning its summary
+// once the repo has been found.
+func cleanupRepo(ctx context.Context, dir string, opts Options, run func(r *repo) error) (*Summary, error) {
+	// Each repo gets its own copy of the options so that one repo's config
+	// doesn't leak into the next
+	r, err := openRepo(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ctx = ctx
+	r.result.Dir = r.dir
+	r.result.DryRun = opts.DryRun
+
+	unlock, err := r.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	err = run(r)
+	return &r.result, err
+}
+
+// cleanup runs the full cleanup: updating the default branch, deleting gone
+// branches, and refreshing worktrees.
+func (r *repo) cleanup() error {
+	if ok, err := r.prepare(); !ok || err != nil {
+		return err
+	}
+
+	return r.runSteps([]step{
+		{PhaseCheckout, r.checkoutDefaultBranch},
+		{PhasePull, infallible(r.pull)},
+		{PhaseVerifySignature, r.verifySignature},
+		{PhasePrune, infallible(r.prune)},
+		{PhasePruneTags, infallible(r.pruneTags)},
+		{PhaseWorktreePrune, infallible(r.pruneWorktrees)},
+		{PhaseClassify, r.classifyBranches},
+		{PhaseConfirm, infallible(r.confirmOldBranches)},
+		{PhaseClassify, infallible(func() {
+			if !r.opts.runsPhase(PhaseWorktreeReset) {
+				r.keepWorktreeBranches()
+			}
+		})},
+		{PhaseConfirm, infallible(r.confirm)},
+		{PhaseWorktreeReset, infallible(r.resetWorktrees)},
+		{PhaseDelete, infallible(r.deleteGoneBranches)},
+		{PhasePoolRebase, infallible(r.rebaseWorktreePool)},
+		{PhaseVerify, infallible(r.verify)},
+		{PhasePostHook, infallible(r.runPostHook)},
+	})
+}
+
+// cleanupWorktrees resets worktrees of gone branches and rebases the worktree
+// pool, without deleting any branches.
+func (r *repo) cleanupWorktrees() error {
+	if ok, err := r.prepare(); !ok || err != nil {
+		return err
+	}
+
+	return r.runSteps([]step{
+		{PhaseWorktreePrune, infallible(r.pruneWorktrees)},
+		{PhaseClassify, r.classifyBranches},
+		// Only the worktrees are reset, so the branches themselves are kept
+		{PhaseClassify, infallible(func() { r.branches.DeletedBranches = nil })},
+		{PhaseConfirm, infallible(r.confirm)},
+		{PhaseWorktreeReset, infallible(r.resetWorktrees)},
+		{PhasePoolRebase, infallible(r.rebaseWorktreePool)},
+	})
+}
+
+// cleanupPool pulls the default branch and rebases the worktree pool onto it,
+// leaving every other branch and worktree alone.
+func (r *repo) cleanupPool() error {
+	if ok, err := r.prepare(); !ok || err != nil {
+		return err
+	}
+
+	return r.runSteps([]step{
+		{PhaseCheckout, r.checkoutDefaultBranch},
+		{PhasePull, infallible(r.pull)},
+		{PhaseVerifySignature, r.verifySignature},
+		{PhaseClassify, r.classifyBranches},
+		{PhasePoolRebase, infallible(r.rebaseWorktreePool)},
+	})
+}
+
+// cleanupLocal deletes local branches that were never pushed anywhere once
+// they are fully merged into the default branch.
+func (r *repo) cleanupLocal() error {
+	if ok, err := r.prepare(); !ok || err != nil {
+		return err
+	}
+
+	return r.runSteps([]step{
+		{PhaseClassify, r.classifyLocalBranches},
+		{PhaseConfirm, infallible(r.confirm)},
+		{PhaseDelete, infallible(r.deleteGoneBranches)},
+		{PhaseVerify, infallible(r.verify)},
+	})
+}
+
+// classifyLocalBranches finds the branches without an upstream, deleting only
+// those fully merged into the default branch as the others may be intentional.
+func (r *repo) classifyLocalBranches() error {
+	output, err := r.runner.Run("for-each-ref", "--format=%(refname:short)%00%(upstream)%00%(worktreepath)", "refs/heads")
+	if err != nil {
+		return fmt.Errorf("failed to get branch info: %w", err)
+	}
+
+	merged, err := r.runner.Run("for-each-ref", "--format=%(refname:short)", "--merged", r.defaultBranch, "refs/heads")
+	if err != nil {
+		return fmt.Errorf("failed to get merged branches: %w", err)
+	}
+
+	mergedBranches := strings.Fields(string(merged))
+
+	var branches branchInfo
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 3 {
+			continue
+		}
+
+		branch, upstream, worktreePath := fields[0], fields[1], fields[2]
+		if upstream != "" || worktreePath != "" || branch == r.defaultBranch || !r.isIncluded(branch) {
+			continue
+		}
+
+		if r.isProtected(branch) {
+			warn("Skipping protected branch: %s", branch)
+			r.result.SkippedBranches = append(r.result.SkippedBranches, branch)
+		} else if !slices.Contains(mergedBranches, branch) {
+			warn("Skipping local branch that isn't merged into %s: %s", r.defaultBranch, branch)
+			r.result.SkippedBranches = append(r.result.SkippedBranches, branch)
+		} else {
+			branches.DeletedBranches = append(branches.DeletedBranches, branch)
+		}
+	}
+
+	r.branches = branches
+	return nil
+}
+
+// cleanupBranches prunes and deletes gone branches without touching any
+// worktrees.
+func (r *repo) cleanupBranches() error {
+	if ok, err := r.prepare(); !ok || err != nil {
+		return err
+	}
+
+	return r.runSteps([]step{
+		{PhasePrune, infallible(r.prune)},
+		{PhasePruneTags, infallible(r.pruneTags)},
+		{PhaseClassify, r.classifyBranches},
+		{PhaseConfirm, infallible(r.confirmOldBranches)},
+		{PhaseClassify, infallible(r.keepWorktreeBranches)},
+		{PhaseConfirm, infallible(r.confirm)},
+		{PhaseDelete, infallible(r.deleteGoneBranches)},
+		{PhaseVerify, infallible(r.verify)},
+	})
+}
+
+// keepWorktreeBranches skips deleting branches checked out in a worktree, as
+// they can't be deleted until the worktree has been reset.
+func (r *repo) keepWorktreeBranches() {
+	for _, branch := range r.branches.WorktreeBranches {
+		warn("Skipping branch checked out in a worktree: %s", branch)
+		r.branches.DeletedBranches = slices.DeleteFunc(r.branches.DeletedBranches, func(b string) bool {
+			return b == branch
+		})
+		r.result.SkippedBranches = append(r.result.SkippedBranches, branch)
+	}
+
+	r.branches.WorktreeBranches = nil
+}
+
+// prepare detects the default and current branches, returning false if the
+// repo has nothing to clean up.
+func (r *repo) prepare() (bool, error) {
+	// Without a remote there is nothing to pull from and no way for a branch
+	// to be gone, so skip the repo entirely
+	hasRemote, err := r.hasRemote()
+	if err != nil {
+		return false, fmt.Errorf("failed to list remotes: %w", err)
+	}
+
+	if !hasRemote {
+		warn("No remote configured, nothing to prune")
+		return false, nil
+	}
+
+	// Get default branch, trusting the user's choice when they provide one as
+	// long as it exists
+	if r.opts.DefaultBranch != "" {
+		if !r.branchExists(r.opts.DefaultBranch) {
+			return false, fmt.Errorf("default branch %s does not exist locally or on %s", r.opts.DefaultBranch, r.opts.Remote)
+		}
+
+		r.defaultBranch = r.opts.DefaultBranch
+	} else {
+		r.defaultBranch, err = r.cachedDefaultBranch(r.getDefaultBranch)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	r.worktreeBase, err = r.getWorktreeBase()
+	if err != nil {
+		return false, err
+	}
+
+	r.currentBranch, err = r.getCurrentBranch()
+	if err != nil {
+		return false, fmt.Errorf("failed to get current branch: %w", err)
+	}
+
+	return true, nil
+}
+
+// getWorktreeBase returns the branch worktrees are reset and rebased onto,
+// using the remote-tracking branch when the base only exists on the remote.
+func (r *repo) getWorktreeBase() (string, error) {
+	base := r.opts.WorktreeBase
+	if base == "" || base == r.defaultBranch {
+		return r.defaultBranch, nil
+	}
+
+	if _, err := r.runner.Run("show-ref", "--verify", "--quiet", "refs/heads/"+base); err == nil {
+		return base, nil
+	}
+
+	if _, err := r.runner.Run("show-ref", "--verify", "--quiet", "refs/remotes/"+r.opts.Remote+"/"+base); err == nil {
+		return r.opts.Remote + "/" + base, nil
+	}
+
+	return "", fmt.Errorf("worktree base %s does not exist locally or on %s", base, r.opts.Remote)
+}
+
+func (r *repo) checkoutDefaultBranch() error {
+	if r.currentBranch == r.defaultBranch || r.opts.KeepCurrent {
+		return nil
+	}
+
+	// Make sure we won't lose local changes when switching branches
+	dirty, err := r.hasUncommittedChanges(r.dir)
+	if err != nil {
+		return fmt.Errorf("failed to check working tree status: %w", err)
+	}
+
+	if dirty {
+		if !r.opts.Autostash {
+			return fmt.Errorf("%s has uncommitted changes, commit or stash them before running cleanup (or use --autostash)", r.currentBranch)
+		}
+
+		err := streamer.Run("Stashing uncommitted changes", func(outputChan chan<- string) error {
+			return r.runGit(outputChan, "stash", "push", "-m", "git-cleanup autostash on "+r.currentBranch)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to stash changes: %w", err)
+		}
+
+		warn("Changes on %s were stashed, run `git stash pop` after checking it out to restore them", r.currentBranch)
+	}
+
+	// Pulling into any other branch would merge the default branch into it,
+	// so there is no point continuing if the checkout fails
+	err = streamer.Run("Checking out default branch", func(outputChan chan<- string) error {
+		return r.checkoutBranch(r.defaultBranch, outputChan)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to checkout %s: %w", r.defaultBranch, err)
+	}
+
+	r.currentBranch = r.defaultBranch
+	return nil
+}
+
+// pull updates the default branch with the latest changes from the remote.
+// Errors from this and the following phases are collected so that one failure
+// doesn't prevent the rest of the cleanup from running.
+func (r *repo) pull() {
+	if r.opts.NoPull {
+		return
+	}
+
+	before := r.revParse(r.defaultBranch)
+	err := streamer.Run("Pulling latest changes", func(outputChan chan<- string) error {
+		// When staying on another branch, update the default branch without
+		// checking it out
+		if r.currentBranch != r.defaultBranch {
+			return r.fastForwardBranch(r.defaultBranch, outputChan)
+		}
+
+		return r.pullBranch(r.defaultBranch, outputChan)
+	})
+	if err != nil {
+		r.result.FailedOperations = append(r.result.FailedOperations, "pull "+r.defaultBranch)
+		r.errs = append(r.errs, fmt.Errorf("failed to pull %s: %w", r.defaultBranch, err))
+		return
+	}
+
+	r.printAdvance(before)
+}
+
+// printAdvance prints how many commits the default branch moved forward by
+// since it was at the given commit.
+func (r *repo) printAdvance(before string) {
+	after := r.revParse(r.defaultBranch)
+	if streamer.Quiet || before == "" || after == "" || before == after {
+		return
+	}
+
+	output, err := r.runner.Run("rev-list", "--count", before+".."+after)
+	if err != nil {
+		return
+	}
+
+	count, _ := strconv.Atoi(strings.TrimSpace(string(output)))
+	fmt.Printf("%s advanced %s (%s..%s)\n", color.CyanString(r.defaultBranch), color.GreenString("%d %s", count, plural(count, "commit", "commits")), before, after)
+}
+
+// revParse returns the abbreviated commit the local branch points to, or an
+// empty string if it doesn't exist.
+func (r *repo) revParse(branch string) string {
+	output, err := r.runner.Run("rev-parse", "--verify", "--quiet", "--short", "refs/heads/"+branch)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// prune fetches from the remotes tracked by local branches to mark deleted
+// branches as gone. When skipped, gone branches are detected from the
+// remote-tracking refs as of the last fetch.
+func (r *repo) prune() {
+	if r.opts.NoFetch {
+		return
+	}
+
+	err := streamer.Run("Pruning local branches", func(outputChan chan<- string) error {
+		return r.fetchPrune(outputChan)
+	})
+	if err != nil {
+		r.result.FailedOperations = append(r.result.FailedOperations, "prune branches")
+		r.errs = append(r.errs, fmt.Errorf("failed to prune branches: %w", err))
+	}
+
+	if r.opts.PruneRemoteTracking {
+		r.pruneRemoteTracking()
+	}
+}
+
+// pruneRemoteTracking removes remote-tracking refs that no longer exist on
+// their remote, which fetching can leave behind when it's interrupted.
+func (r *repo) pruneRemoteTracking() {
+	var pruned int
+	err := streamer.Run("Pruning remote-tracking refs", func(outputChan chan<- string) error {
+		remotes, err := r.trackedRemotes()
+		if err != nil {
+			return err
+		}
+
+		if err := r.checkAllowedHosts(remotes...); err != nil {
+			return err
+		}
+
+		for _, remote := range remotes {
+			// Pruning is a network operation like fetching, so it gets the same
+			// timeout and retries. Its output isn't kept, so the pruned refs are
+			// found by comparing the refs before and after.
+			before, err := r.remoteTrackingRefs(remote)
+			if err != nil {
+				return err
+			}
+
+			if err := r.runGit(outputChan, "remote", "prune", remote); err != nil {
+				return fmt.Errorf("%s: %w", remote, err)
+			}
+
+			after, err := r.remoteTrackingRefs(remote)
+			if err != nil {
+				return err
+			}
+
+			for _, ref := range before {
+				if !slices.Contains(after, ref) {
+					pruned++
+					outputChan <- "[pruned] " + ref
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		r.result.FailedOperations = append(r.result.FailedOperations, "prune remote-tracking refs")
+		r.errs = append(r.errs, fmt.Errorf("failed to prune remote-tracking refs: %w", err))
+		return
+	}
+
+	if pruned > 0 && !streamer.Quiet {
+		fmt.Printf("Pruned %d remote-tracking %s\n", pruned, plural(pruned, "ref", "refs"))
+	}
+}
+
+// remoteTrackingRefs returns the remote-tracking refs of the remote.
+func (r *repo) remoteTrackingRefs(remote string) ([]string, error) {
+	output, err := r.runner.Run("for-each-ref", "--format=%(refname:short)", "refs/remotes/"+remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote-tracking refs of %s: %w", remote, err)
+	}
+
+	return strings.Fields(string(output)), nil
+}
+
+func (r *repo) classifyBranches() error {
+	branches, err := r.getBranches()
+	if err != nil {
+		return fmt.Errorf("error getting deleted branches: %w", err)
+	}
+
+	for _, branch := range branches.ProtectedBranches {
+		warn("Skipping protected branch: %s", branch)
+		r.result.SkippedBranches = append(r.result.SkippedBranches, branch)
+	}
+
+	for _, branch := range branches.RecentBranches {
+		warn("Skipping recently updated branch: %s", branch)
+		r.result.SkippedBranches = append(r.result.SkippedBranches, branch)
+	}
+
+	if branch := branches.CurrentWorktreeBranch; branch != "" {
+		warn("Skipping current worktree: %s (%s)", r.currentWorktree, branch)
+	}
+
+	for _, branch := range branches.UnmergedBranches {
+		warn("Skipping branch with %d unmerged %s: %s (use --force to delete)", branch.Commits, plural(branch.Commits, "commit", "commits"), branch.Name)
+		r.result.SkippedBranches = append(r.result.SkippedBranches, branch.Name)
+	}
+
+	// Git won't delete the checked out branch, which is only possible here when
+	// staying on the current branch
+	if i := slices.Index(branches.DeletedBranches, r.currentBranch); i != -1 {
+		warn("Skipping current branch: %s (check out another branch to delete it)", r.currentBranch)
+		branches.DeletedBranches = slices.Delete(branches.DeletedBranches, i, i+1)
+		r.result.SkippedBranches = append(r.result.SkippedBranches, r.currentBranch)
+	}
+
+	r.branches = branches
+	return nil
+}
+
+// confirm asks the user to approve each action when running interactively.
+func (r *repo) confirm() {
+	if !r.opts.Interactive {
+		return
+	}
+
+	var declined []string
+	r.branches.WorktreeBranches, r.branches.DeletedBranches, declined = confirmBranches(r.branches.WorktreeBranches, r.branches.DeletedBranches)
+	r.result.SkippedBranches = append(r.result.SkippedBranches, declined...)
+}
+
+func (r *repo) resetWorktrees() {
+	if len(r.branches.WorktreeBranches) == 0 {
+		return
+	}
+
+	errCount := len(r.errs)
+	streamer.BeginProgress("Resetting worktrees", len(r.branches.WorktreeBranches))
+
+	for i, branch := range r.branches.WorktreeBranches {
+		r.resetBranchWorktree(branch, i)
+		streamer.Advance()
+
+		if r.abortOnError() && len(r.errs) > errCount {
+			break
+		}
+	}
+
+	streamer.EndProgress(errors.Join(r.errs[errCount:]...))
+}
+
+// resetBranchWorktree resets the worktree the branch is checked out in, which
+// is the i-th of the worktrees being reset.
+func (r *repo) resetBranchWorktree(branch string, i int) {
+	worktreePath, err := r.getWorktreePath(branch)
+	if errors.Is(err, errWorktreeUnavailable) {
+		// The branch can't be deleted while it's still checked out there
+		warn("Skipping worktree, path unavailable: %s", worktreePath)
+		r.branches.DeletedBranches = slices.DeleteFunc(r.branches.DeletedBranches, func(b string) bool {
+			return b == branch
+		})
+		r.result.SkippedBranches = append(r.result.SkippedBranches, branch)
+		return
+	} else if err != nil {
+		streamer.Above(func() { color.Red("Error finding worktree for branch %s: %v", branch, err) })
+		r.result.FailedOperations = append(r.result.FailedOperations, "reset worktree for "+branch)
+		r.errs = append(r.errs, err)
+		return
+	}
+
+	// Resetting would pile another failure on top of the unresolved one
+	var inProgress *inProgressError
+	if err := r.checkInProgress(worktreePath); errors.As(err, &inProgress) {
+		warn("Skipping worktree, %s in progress (resolve it first): %s", inProgress.Operation, worktreePath)
+		r.branches.DeletedBranches = slices.DeleteFunc(r.branches.DeletedBranches, func(b string) bool {
+			return b == branch
+		})
+		r.result.SkippedBranches = append(r.result.SkippedBranches, branch)
+		return
+	} else if err != nil {
+		r.result.FailedOperations = append(r.result.FailedOperations, "reset worktree for "+branch)
+		r.errs = append(r.errs, err)
+		return
+	}
+
+	// Convert path to relative format
+	homeDir, _ := os.UserHomeDir()
+	relativePath := strings.Replace(worktreePath, homeDir, "~", 1)
+
+	title := fmt.Sprintf("Resetting worktree: %s (%d/%d)", relativePath, i+1, len(r.branches.WorktreeBranches))
+	err = streamer.Run(title, func(outputChan chan<- string) error {
+		return r.resetWorktree(r.worktreeBase, worktreePath, outputChan)
+	})
+	if err != nil {
+		r.result.FailedOperations = append(r.result.FailedOperations, "reset worktree "+relativePath)
+		r.errs = append(r.errs, fmt.Errorf("failed to reset worktree %s: %w", relativePath, err))
+	} else {
+		r.result.ResetWorktrees = append(r.result.ResetWorktrees, relativePath)
+	}
+}
+
+func (r *repo) deleteGoneBranches() {
+	branches := r.branches.DeletedBranches
+	if len(branches) == 0 {
+		return
+	}
+
+	var unmerged []string
+	title := fmt.Sprintf("Deleting %d %s", len(branches), plural(len(branches), "branch", "branches"))
+	streamer.BeginProgress(title, len(branches))
+	err := streamer.Run(title, func(outputChan chan<- string) error {
+		var err error
+		r.result.DeletedBranches, unmerged, err = r.deleteBranches(branches, outputChan)
+		return err
+	})
+	streamer.EndProgress(err)
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("failed to delete branches: %w", err))
+	}
+
+	for _, branch := range unmerged {
+		warn("Skipping unmerged branch: %s (use --force to delete)", branch)
+		r.result.SkippedBranches = append(r.result.SkippedBranches, branch)
+	}
+
+	for _, branch := range branches {
+		if !slices.Contains(r.result.DeletedBranches, branch) && !slices.Contains(unmerged, branch) {
+			r.result.FailedOperations = append(r.result.FailedOperations, "delete "+branch)
+		}
+	}
+}
+
+func (r *repo) rebaseWorktreePool() {
+	r.checkOrphanedStashes()
+	r.createPoolWorktrees()
+
+	if len(r.branches.WorktreePoolBranches) == 0 {
+		return
+	}
+
+	branches := r.branches.WorktreePoolBranches
+	var skipped []string
+	streamer.BeginProgress("Rebasing worktree pool", len(branches))
+	err := streamer.Run("Rebasing worktree pool", func(outputChan chan<- string) error {
+		// Each pool branch has its own worktree, so they can be rebased
+		// alongside each other
+		errs := make([]error, len(branches))
+		queue := make(chan int)
+
+		// Once a rebase fails, aborting leaves the rest of the pool alone
+		var failed atomic.Bool
+
+		var wg sync.WaitGroup
+		for i := 0; i < max(1, min(r.opts.MaxParallelWorktrees, len(branches))); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for i := range queue {
+					if r.abortOnError() && failed.Load() {
+						errs[i] = errAborted
+						continue
+					}
+
+					errs[i] = r.rebasePoolBranch(branches[i], r.worktreeBase, outputChan)
+					if errs[i] != nil && !errors.Is(errs[i], errUpToDate) && skipReason(errs[i]) == "" {
+						failed.Store(true)
+					}
+
+					streamer.Advance()
+				}
+			}()
+		}
+
+		for i := range branches {
+			queue <- i
+		}
+
+		close(queue)
+		wg.Wait()
+
+		var rebaseErrs []error
+		for i, branch := range branches {
+			// Branches already up to date weren't rebased, so aren't reported
+			if errors.Is(errs[i], errAborted) || errors.Is(errs[i], errUpToDate) {
+				continue
+			} else if reason := skipReason(errs[i]); reason != "" {
+				skipped = append(skipped, fmt.Sprintf("Skipping worktree pool branch, %s: %s", reason, branch))
+				r.result.SkippedBranches = append(r.result.SkippedBranches, branch)
+			} else if errs[i] != nil {
+				r.result.FailedOperations = append(r.result.FailedOperations, "rebase "+branch)
+				rebaseErrs = append(rebaseErrs, fmt.Errorf("%s: %w", branch, errs[i]))
+			} else {
+				r.result.RebasedBranches = append(r.result.RebasedBranches, branch)
+			}
+		}
+
+		return errors.Join(rebaseErrs...)
+	})
+	streamer.EndProgress(err)
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("failed to rebase worktree pool: %w", err))
+	}
+
+	for _, message := range skipped {
+		warn("%s", message)
+	}
+}
+
+// skipReason returns why a worktree pool branch was skipped rather than
+// rebased, or nothing if the error is a failure.
+func skipReason(err error) string {
+	var inProgress *inProgressError
+	switch {
+	case errors.Is(err, errWorktreeUnavailable):
+		return "path unavailable"
+	case errors.As(err, &inProgress):
+		return fmt.Sprintf("%s in progress in %s (resolve it first)", inProgress.Operation, inProgress.Path)
+	case errors.Is(err, errDirtyWorktree):
+		return "worktree has uncommitted changes"
+	}
+
+	return ""
+}
+
+// runPostHook runs the user's post hook in the repo once everything else has
+// succeeded.
+func (r *repo) runPostHook() {
+	if r.opts.PostHook == "" || len(r.errs) > 0 {
+		return
+	}
+
+	err := streamer.Run("Running post hook", func(outputChan chan<- string) error {
+		cmd := exec.CommandContext(r.ctx, "sh", "-c", r.opts.PostHook)
+		cmd.Dir = r.dir
+		return r.runCommand(cmd, outputChan)
+	})
+	if err != nil {
+		r.result.FailedOperations = append(r.result.FailedOperations, "post hook")
+		r.errs = append(r.errs, fmt.Errorf("post hook failed: %w", err))
+	}
+}
+
+// finish prints the summary and returns any errors collected along the way,
+// along with the error that aborted the cleanup, if any.
+func (r *repo) finish(aborted error) error {
+	if !streamer.Quiet {
+		r.result.print()
+	}
+
+	if len(r.explained) > 0 {
+		if r.opts.DryRun {
+			color.Cyan("Commands that would run:")
+		} else {
+			color.Cyan("Commands run:")
+		}
+
+		for _, line := range r.explained {
+			fmt.Println("  " + line)
+		}
+	}
+
+	if r.opts.ReportFile != "" {
+		if err := r.writeReport(r.opts.ReportFile, aborted); err != nil {
+			r.errs = append(r.errs, fmt.Errorf("failed to write report: %w", err))
+		}
+	}
+
+	if aborted != nil && len(r.errs) > 0 {
+		return errors.Join(aborted, &PartialError{r.errs})
+	} else if aborted != nil {
+		return aborted
+	} else if len(r.errs) > 0 {
+		return &PartialError{r.errs}
+	}
+
+	if streamer.Quiet {
+		return nil
+	}
+
+	if r.opts.DryRun {
+		color.Green("✔ Dry run completed, nothing was changed")
+	} else {
+		color.Green("✔ Git cleanup completed")
+	}
+
+	return nil
+}
+
+// getRootDir returns the main worktree of the repository containing dir, which
+// is where the cleanup operations are run. The runner runs git in dir.
+func getRootDir(runner GitRunner, dir string) (string, error) {
+	lines, err := gitLines(runner, "rev-parse", "--is-bare-repository", "--git-common-dir")
+	if err != nil {
+		return "", checkRepoDir(dir, err)
+	}
+
+	if len(lines) < 2 {
+		return "", fmt.Errorf("unexpected output from git rev-parse: %q", strings.Join(lines, "\n"))
+	}
+
+	// The common dir is relative to dir when we are in the main worktree
+	commonDir := lines[1]
+	if !filepath.IsAbs(commonDir) {
+		commonDir, err = filepath.Abs(filepath.Join(dir, commonDir))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// core.worktree moves the main worktree away from the common dir
+	if worktree, _ := gitLines(runner, "config", "--get", "core.worktree"); len(worktree) > 0 {
+		if filepath.IsAbs(worktree[0]) {
+			return worktree[0], nil
+		}
+
+		return filepath.Join(commonDir, worktree[0]), nil
+	}
+
+	// Bare repos have no main worktree, but can still be cleaned from one of
+	// their linked worktrees
+	if bare, _ := gitLines(runner, "config", "--bool", "core.bare"); lines[0] == "true" || (len(bare) > 0 && bare[0] == "true") {
+		toplevel, err := gitLines(runner, "rev-parse", "--show-toplevel")
+		if err != nil || len(toplevel) == 0 {
+			return "", errors.New("bare repositories have no working tree, run git-cleanup from one of its worktrees instead")
+		}
+
+		return toplevel[0], nil
+	}
+
+	return filepath.Dir(commonDir), nil
+}
+
+// errNotRepository is returned when cleaning up a directory outside of any git
+// repository.
+var errNotRepository = errors.New("not inside a git repository")
+
+// checkRepoDir explains why the git directory of dir couldn't be found, as
+// git's own errors don't make it clear whether the directory or git is at
+// fault.
+func checkRepoDir(dir string, err error) error {
+	if dir != "" {
+		if info, statErr := os.Stat(dir); statErr != nil {
+			return errors.New("directory does not exist")
+		} else if !info.IsDir() {
+			return errors.New("not a directory")
+		}
+	}
+
+	if strings.Contains(err.Error(), "not a git repository") {
+		return fmt.Errorf("%w (run git-cleanup from a repository or pass --cwd)", errNotRepository)
+	}
+
+	return fmt.Errorf("failed to find git directory: %w", err)
+}
+
+// gitLines runs a git command with the runner and returns the trimmed,
+// non-empty lines of its output.
+func gitLines(runner GitRunner, args ...string) ([]string, error) {
+	output, err := runner.Run(args...)
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return nil, errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+	} else if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, nil
+}
+
+func (r *repo) hasRemote() (bool, error) {
+	output, err := r.runner.Run("remote")
+	if err != nil {
+		return false, err
+	}
+
+	return len(strings.TrimSpace(string(output))) > 0, nil
+}
+
+// DetectMethods are the ways the default branch can be detected, in the order
+// they are tried by default.
+var DetectMethods = []string{"symbolic-ref", "rev-parse", "config"}
+
+func (r *repo) getDefaultBranch() (string, error) {
+	methods := map[string][]string{
+		"symbolic-ref": {"symbolic-ref", "refs/remotes/" + r.opts.Remote + "/HEAD"},
+		"rev-parse":    {"rev-parse", "--abbrev-ref", r.opts.Remote + "/HEAD"},
+		"config":       {"config", "--get", "init.defaultBranch"},
+	}
+
+	order := r.opts.DetectOrder
+	if len(order) == 0 {
+		order = DetectMethods
+	}
+
+	for _, name := range order {
+		output, err := r.runner.Run(methods[name]...)
+		if err == nil {
+			result := strings.TrimSpace(string(output))
+
+			result = strings.TrimPrefix(result, "refs/heads/")
+			result = strings.TrimPrefix(result, "refs/remotes/")
+			result = strings.TrimPrefix(result, r.opts.Remote+"/")
+
+			if result != "" {
+				return result, nil
+			}
+		}
+	}
+
+	// The forge is only asked as a last resort, as it needs the network
+	if r.opts.ForgeDefault {
+		branch, err := r.getForgeDefaultBranch()
+		if err == nil {
+			return branch, nil
+		}
+
+		slog.Debug("failed to get the default branch from the forge", "error", err)
+		order = append(slices.Clip(order), "forge")
+	}
+
+	return "", fmt.Errorf("failed to detect the default branch using %s, set it with --default-branch", strings.Join(order, ", "))
+}
+
+// branchExists reports whether the branch exists locally or on the remote.
+func (r *repo) branchExists(branch string) bool {
+	for _, ref := range []string{"refs/heads/" + branch, "refs/remotes/" + r.opts.Remote + "/" + branch} {
+		if _, err := r.runner.Run("show-ref", "--verify", "--quiet", ref); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *repo) getCurrentBranch() (string, error) {
+	output, err := r.runner.Run("branch", "--show-current")
+	if err != nil {
+		return "", fmt.Errorf("failed to get current branch: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (r *repo) checkoutBranch(branch string, outputChan chan<- string) error {
+	return r.runGit(outputChan, "checkout", branch)
+}
+
+func (r *repo) pullBranch(branch string, outputChan chan<- string) error {
+	// Never create a merge commit on the default branch unless asked to
+	args := []string{"pull"}
+	if r.opts.PullRebase {
+		args = append(args, "--rebase")
+	} else if r.opts.FFOnly {
+		args = append(args, "--ff-only")
+	}
+
+	if err := r.checkAllowedHosts(r.opts.Remote); err != nil {
+		return err
+	}
+
+	err := r.runGit(outputChan, append(args, r.opts.Remote, branch)...)
+	if err == nil {
+		return nil
+	}
+
+	// Don't leave the repo stuck in the middle of a conflicted pull
+	if r.abortPull(outputChan) || strings.Contains(err.Error(), "divergent branches") || strings.Contains(err.Error(), "Not possible to fast-forward") {
+		hint := "resolve it manually or pass --pull-rebase"
+		if r.opts.PullRebase {
+			hint = "resolve it manually"
+		} else if r.opts.FFOnly {
+			hint = "resolve it manually, pass --pull-rebase, or pass --ff-only=false to merge"
+		}
+
+		return fmt.Errorf("%w\n%s has diverged from %s, %s", err, branch, r.opts.Remote, hint)
+	}
+
+	return err
+}
+
+// abortPull aborts a merge or rebase left in progress by a failed pull,
+// reporting whether there was one to abort.
+func (r *repo) abortPull(outputChan chan<- string) bool {
+	for _, op := range []struct{ head, command string }{
+		{"MERGE_HEAD", "merge"},
+		{"REBASE_HEAD", "rebase"},
+	} {
+		if _, err := r.runner.Run("rev-parse", "--quiet", "--verify", op.head); err != nil {
+			continue
+		}
+
+		outputChan <- fmt.Sprintf("Aborting conflicted %s...", op.command)
+		if _, err := r.combinedOutput(r.git(op.command, "--abort")); err != nil {
+			outputChan <- fmt.Sprintf("Warning: failed to abort %s: %v", op.command, err)
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// fastForwardBranch updates a local branch to match the remote without
+// checking it out. This fails rather than merging if the branch has diverged.
+func (r *repo) fastForwardBranch(branch string, outputChan chan<- string) error {
+	if err := r.checkAllowedHosts(r.opts.Remote); err != nil {
+		return err
+	}
+
+	return r.runGit(outputChan, "fetch", r.opts.Remote, branch+":"+branch)
+}
+
+func (r *repo) fetchPrune(outputChan chan<- string) error {
+	if r.opts.FetchAll {
+		output, err := r.runner.Run("remote")
+		if err != nil {
+			return fmt.Errorf("failed to list remotes: %w", err)
+		}
+
+		if err := r.checkAllowedHosts(strings.Fields(string(output))...); err != nil {
+			return err
+		}
+
+		return r.runGit(outputChan, "fetch", "--all", "--prune")
+	}
+
+	remotes, err := r.trackedRemotes()
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkAllowedHosts(remotes...); err != nil {
+		return err
+	}
+
+	return r.runGit(outputChan, append([]string{"fetch", "-p", "--multiple"}, remotes...)...)
+}
+
+// trackedRemotes returns the remote along with any other remotes that local
+// branches track.
+func (r *repo) trackedRemotes() ([]string, error) {
+	output, err := r.runner.Run("for-each-ref", "--format=%(upstream:remotename)", "refs/heads")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tracked remotes: %w", err)
+	}
+
+	remotes := []string{r.opts.Remote}
+	for _, remote := range strings.Fields(string(output)) {
+		if !slices.Contains(remotes, remote) {
+			remotes = append(remotes, remote)
+		}
+	}
+
+	return remotes, nil
+}
+
+// branchInfo classifies the local branches of a repo.
+type branchInfo struct {
+	DeletedBranches      []string
+	WorktreeBranches     []string
+	WorktreePoolBranches []string
+	ProtectedBranches    []string
+	RecentBranches       []string
+	UnmergedBranches     []unmergedBranch
+	// OldBranches are older than the max branch age, so need to be confirmed
+	// before they are deleted
+	OldBranches []oldBranch
+	// MergedBranches have been merged into the default branch, either
+	// directly or by a squash merge, but git may not see them as merged into
+	// their upstream, so have to be force deleted
+	MergedBranches []string
+	// Reasons is why each of the DeletedBranches is deleted
+	Reasons map[string]string
+	// GoneRemotes is the remote each gone branch tracked
+	GoneRemotes map[string]string
+	// GoneSHAs is the commit each deleted branch points to
+	GoneSHAs map[string]string
+	// CurrentWorktreeBranch is checked out in the worktree git-cleanup was run
+	// from, which is left alone
+	CurrentWorktreeBranch string
+}
+
+// unmergedBranch is a gone branch with commits that aren't in the default
+// branch, which would be lost if it were deleted.
+type unmergedBranch struct {
+	Name    string
+	Commits int
+}
+
+type oldBranch struct {
+	Name       string
+	Age        time.Duration
+	InWorktree bool
+}
+
+// branchFormat is the for-each-ref format getBranches parses. Each field is
+// separated by a NUL byte so that empty fields are preserved.
+var branchFormat = strings.Join([]string{
+	"%(refname:short)",
+	"%(HEAD)",
+	"%(upstream:remotename)",
+	"%(upstream:track)",
+	"%(worktreepath)",
+	"%(committerdate:unix)",
+	"%(objectname)",
+}, "%00")
+
+func (r *repo) getBranches() (branchInfo, error) {
+	result := branchInfo{
+		GoneRemotes: make(map[string]string),
+		GoneSHAs:    make(map[string]string),
+		Reasons:     make(map[string]string),
+	}
+
+	output, err := r.runner.Run("for-each-ref", "--format="+branchFormat, "refs/heads")
+	if err != nil {
+		return result, fmt.Errorf("failed to get branch info: %w", err)
+	}
+
+	var mergedBranches []string
+	if r.opts.PruneMerged {
+		merged, err := r.runner.Run("for-each-ref", "--format=%(refname:short)", "--merged", r.defaultBranch, "refs/heads")
+		if err != nil {
+			return result, fmt.Errorf("failed to get merged branches: %w", err)
+		}
+
+		mergedBranches = strings.Fields(string(merged))
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\x00")
+		if len(fields) != 7 {
+			slog.Debug("skipping malformed branch line", "line", scanner.Text())
+			continue
+		}
+
+		branch, head, remote, track, worktreePath := fields[0], fields[1], fields[2], fields[3], fields[4]
+		committedAt, _ := strconv.ParseInt(fields[5], 10, 64)
+
+		// Branches checked out in the main worktree are marked as HEAD, any other
+		// worktree path means the branch is checked out in a linked worktree
+		inWorktree := worktreePath != "" && head != "*"
+
+		if inWorktree && r.opts.ExcludeCurrentWorktree && worktreePath == r.currentWorktree {
+			slog.Debug("keeping branch", "branch", branch, "reason", "checked out in the current worktree")
+			result.CurrentWorktreeBranch = branch
+			continue
+		}
+
+		// Branches can track any remote, not only the one we pull from
+		gone := remote != "" && track == "[gone]"
+		poolBranch := inWorktree && strings.TrimPrefix(filepath.Base(worktreePath), r.opts.WorktreePrefix) == branch
+
+		// Merged branches are deleted whether or not they have an upstream,
+		// other than the branches checked out in the main worktree
+		merged := !gone && slices.Contains(mergedBranches, branch) && branch != r.defaultBranch && head != "*" && !poolBranch
+
+		// Squash merged branches are deleted even when their remote branch
+		// lingers, as long as they have commits the default branch doesn't
+		squashed := false
+		if !gone && !merged && remote != "" && r.opts.DeleteSquashed && branch != r.defaultBranch && !poolBranch {
+			commits, err := r.countUnmergedCommits(branch)
+			if err != nil {
+				return result, err
+			}
+
+			if commits > 0 {
+				if squashed, err = r.isSquashMerged(branch); err != nil {
+					return result, err
+				}
+			}
+		}
+
+		if gone || squashed || merged {
+			reason := "gone from " + remote
+			if gone {
+				result.GoneRemotes[branch] = remote
+			} else if merged {
+				reason = "merged into " + r.defaultBranch
+				result.MergedBranches = append(result.MergedBranches, branch)
+			} else {
+				reason = "squash merged into " + r.defaultBranch
+				result.MergedBranches = append(result.MergedBranches, branch)
+			}
+
+			result.GoneSHAs[branch] = fields[6]
+
+			// Only the included branches are cleaned up, leaving everything else
+			// alone without reporting it as skipped
+			if !r.isIncluded(branch) {
+				slog.Debug("keeping branch", "branch", branch, "reason", "not included")
+				continue
+			}
+
+			// Skip branches the user has asked us to keep
+			if r.isProtected(branch) {
+				slog.Debug("keeping branch", "branch", branch, "reason", "protected")
+				result.ProtectedBranches = append(result.ProtectedBranches, branch)
+				continue
+			}
+
+			// Keep branches with recent commits in case they are still needed
+			if r.opts.Since > 0 && time.Since(time.Unix(committedAt, 0)) < r.opts.Since {
+				slog.Debug("keeping branch", "branch", branch, "reason", "recent commits", "committed", time.Unix(committedAt, 0))
+				result.RecentBranches = append(result.RecentBranches, branch)
+				continue
+			}
+
+			// Keep branches with commits that were never merged unless forced
+			if !r.opts.Force {
+				commits, err := r.countUnmergedCommits(branch)
+				if err != nil {
+					return result, err
+				}
+
+				if commits > 0 && !squashed && r.opts.DeleteSquashed {
+					if squashed, err = r.isSquashMerged(branch); err != nil {
+						return result, err
+					}
+
+					if squashed {
+						reason = "squash merged into " + r.defaultBranch
+						result.MergedBranches = append(result.MergedBranches, branch)
+					}
+				}
+
+				if commits > 0 && !squashed {
+					slog.Debug("keeping branch", "branch", branch, "reason", "unmerged commits", "commits", commits)
+					result.UnmergedBranches = append(result.UnmergedBranches, unmergedBranch{branch, commits})
+					continue
+				}
+			}
+
+			// Branches gone for this long are more likely to have been forgotten
+			// than finished with, so ask before deleting them. This is skipped
+			// when every deletion is confirmed anyway.
+			age := time.Since(time.Unix(committedAt, 0))
+			if r.opts.MaxBranchAge > 0 && age > r.opts.MaxBranchAge && !r.opts.Force && !r.opts.Interactive {
+				slog.Debug("keeping branch", "branch", branch, "reason", "older than max branch age", "committed", time.Unix(committedAt, 0))
+				result.OldBranches = append(result.OldBranches, oldBranch{branch, age, inWorktree})
+				continue
+			}
+
+			if inWorktree {
+				slog.Debug("resetting worktree", "branch", branch, "worktree", worktreePath, "reason", reason)
+				result.WorktreeBranches = append(result.WorktreeBranches, branch)
+			}
+
+			slog.Debug("deleting branch", "branch", branch, "reason", reason)
+			result.Reasons[branch] = reason
+			result.DeletedBranches = append(result.DeletedBranches, branch)
+		} else if poolBranch {
+			slog.Debug("rebasing branch", "branch", branch, "worktree", worktreePath, "reason", "worktree pool")
+			result.WorktreePoolBranches = append(result.WorktreePoolBranches, branch)
+		} else {
+			slog.Debug("keeping branch", "branch", branch, "reason", "not gone", "upstream", remote, "track", track)
+		}
+	}
+
+	return result, nil
+}
+
+// countUnmergedCommits returns the number of commits on the branch that aren't
+// reachable from the default branch.
+func (r *repo) countUnmergedCommits(branch string) (int, error) {
+	output, err := r.runner.Run("rev-list", "--count", r.defaultBranch+".."+branch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count unmerged commits on %s: %w", branch, err)
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(output)))
+}
+
+// isIncluded reports whether the branch matches one of the include patterns,
+// which every branch does when there are none.
+func (r *repo) isIncluded(branch string) bool {
+	if len(r.opts.Include) == 0 {
+		return true
+	}
+
+	for _, pattern := range r.opts.Include {
+		if matched, _ := filepath.Match(pattern, branch); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *repo) isProtected(branch string) bool {
+	for _, pattern := range r.opts.Protect {
+		// Patterns are validated up front, but a malformed one protects
+		// everything rather than nothing
+		if matched, err := filepath.Match(pattern, branch); matched || err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *repo) deleteBranch(branch string, outputChan chan<- string) error {
+	if remote := r.branches.GoneRemotes[branch]; remote != "" && remote != r.opts.Remote {
+		outputChan <- fmt.Sprintf("%s is gone from %s", branch, remote)
+	}
+
+	if err := r.backupBranch(branch); err != nil {
+		return fmt.Errorf("failed to back up branch before deleting: %w", err)
+	}
+
+	// Like git, only delete branches that aren't fully merged when forced, or
+	// when their changes were merged into the default branch
+	if r.opts.Force || slices.Contains(r.branches.MergedBranches, branch) {
+		return r.runGit(outputChan, "branch", "-D", branch)
+	}
+
+	err := r.runGit(outputChan, "branch", "-d", branch)
+	if err != nil && strings.Contains(err.Error(), "not fully merged") {
+		return fmt.Errorf("%w: %v", errNotMerged, err)
+	}
+
+	return err
+}
+
+var errNotMerged = errors.New("branch is not fully merged")
+
+// errAborted marks the items of a phase left alone after an earlier one
+// failed, when aborting on errors.
+var errAborted = errors.New("aborted after an earlier failure")
+
+// deleteBranches deletes the given branches using a pool of workers, returning
+// the branches that were deleted, those git refused to delete as they aren't
+// fully merged, and an aggregate error for any others that weren't deleted.
+func (r *repo) deleteBranches(branches []string, outputChan chan<- string) ([]string, []string, error) {
+	errs := make([]error, len(branches))
+	queue := make(chan int)
+
+	// Count the branches as they finish so the output shows how far through
+	// the list the deletion is
+	var done atomic.Int32
+
+	// Once a deletion fails, aborting keeps the rest of the branches
+	var failed atomic.Bool
+	progress := func(branch string, err error) string {
+		count := fmt.Sprintf("(%d/%d)", done.Add(1), len(branches))
+		if errors.Is(err, errNotMerged) {
+			return fmt.Sprintf("Skipped unmerged branch: %s %s", branch, count)
+		} else if err != nil {
+			return fmt.Sprintf("Failed to delete branch: %s %s", branch, count)
+		}
+
+		return fmt.Sprintf("Deleted branch: %s %s", branch, count)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(1, min(r.opts.Jobs, len(branches))); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range queue {
+				if r.abortOnError() && failed.Load() {
+					errs[i] = errAborted
+					continue
+				}
+
+				err := r.deleteBranch(branches[i], outputChan)
+				if err != nil {
+					errs[i] = fmt.Errorf("%s: %w", branches[i], err)
+				}
+
+				if err != nil && !errors.Is(err, errNotMerged) {
+					failed.Store(true)
+				}
+
+				outputChan <- progress(branches[i], err)
+				streamer.Advance()
+			}
+		}()
+	}
+
+	for i := range branches {
+		queue <- i
+	}
+
+	close(queue)
+	wg.Wait()
+
+	var deleted, unmerged []string
+	for i, branch := range branches {
+		if errors.Is(errs[i], errAborted) {
+			errs[i] = nil
+		} else if errs[i] == nil {
+			deleted = append(deleted, branch)
+		} else if errors.Is(errs[i], errNotMerged) {
+			unmerged = append(unmerged, branch)
+			errs[i] = nil
+		}
+	}
+
+	return deleted, unmerged, errors.Join(errs...)
+}
+
+// worktree is an entry from `git worktree list --porcelain`.
+type worktree struct {
+	Path     string
+	Branch   string
+	Prunable bool
+}
+
+func (r *repo) listWorktrees() ([]worktree, error) {
+	output, err := r.runner.Run("worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get worktree list: %w", err)
+	}
+
+	var worktrees []worktree
+
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Each entry starts with its path, followed by its attributes
+		if strings.HasPrefix(line, "worktree ") {
+			worktrees = append(worktrees, worktree{Path: strings.TrimPrefix(line, "worktree ")})
+		} else if len(worktrees) == 0 {
+			continue
+		} else if strings.HasPrefix(line, "branch ") {
+			worktrees[len(worktrees)-1].Branch = strings.TrimPrefix(line, "branch ")
+		} else if line == "prunable" || strings.HasPrefix(line, "prunable ") {
+			worktrees[len(worktrees)-1].Prunable = true
+		}
+	}
+
+	return worktrees, nil
+}
+
+func (r *repo) getWorktreePath(branch string) (string, error) {
+	worktrees, err := r.listWorktrees()
+	if err != nil {
+		return "", err
+	}
+
+	for _, worktree := range worktrees {
+		if worktree.Branch != "refs/heads/"+branch {
+			continue
+		}
+
+		// Skip worktrees whose directory has been removed without telling git
+		if worktree.Prunable {
+			continue
+		}
+
+		// Worktrees on a drive that isn't mounted are kept by git, but can't be
+		// touched until the drive is back
+		if info, err := os.Stat(worktree.Path); err != nil || !info.IsDir() {
+			return worktree.Path, fmt.Errorf("%w: %s", errWorktreeUnavailable, worktree.Path)
+		}
+
+		return worktree.Path, nil
+	}
+
+	return "", fmt.Errorf("worktree not found for branch %s", branch)
+}
+
+var errWorktreeUnavailable = errors.New("worktree path unavailable")
+
+// inProgressError is returned for worktrees in the middle of a rebase or
+// merge, which have to be resolved before they can be rebased again.
+type inProgressError struct {
+	Operation string
+	Path      string
+}
+
+func (e *inProgressError) Error() string {
+	return fmt.Sprintf("%s in progress in %s", e.Operation, e.Path)
+}
+
+// checkInProgress returns an inProgressError if the worktree is in the middle
+// of a rebase or merge.
+func (r *repo) checkInProgress(worktreePath string) error {
+	operations := []struct{ path, operation string }{
+		{"rebase-merge", "rebase"},
+		{"rebase-apply", "rebase"},
+		{"MERGE_HEAD", "merge"},
+	}
+
+	for _, op := range operations {
+		// Each worktree has its own git dir, which git resolves the path in
+		output, err := r.runner.Run("-C", worktreePath, "rev-parse", "--git-path", op.path)
+		if err != nil {
+			return fmt.Errorf("failed to check for a %s in progress: %w", op.operation, err)
+		}
+
+		path := strings.TrimSpace(string(output))
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(worktreePath, path)
+		}
+
+		if _, err := os.Stat(path); err == nil {
+			return &inProgressError{op.operation, worktreePath}
+		}
+	}
+
+	return nil
+}
+
+// pruneWorktrees removes the registrations of worktrees whose directories no
+// longer exist, so they aren't mistaken for worktrees that need resetting.
+func (r *repo) pruneWorktrees() {
+	// The worktrees git prunes are only known before pruning them
+	var pruned []string
+	if r.opts.PruneEmptyWorktreeDirs {
+		worktrees, err := r.listWorktrees()
+		if err != nil {
+			r.errs = append(r.errs, err)
+			return
+		}
+
+		for _, worktree := range worktrees {
+			if worktree.Prunable {
+				pruned = append(pruned, worktree.Path)
+			}
+		}
+	}
+
+	output, err := r.combinedOutput(r.git("worktree", "prune"))
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("failed to prune worktrees: %s", strings.TrimSpace(string(output))))
+		return
+	}
+
+	r.pruneEmptyWorktreeDirs(pruned)
+}
+
+func (r *repo) resetWorktree(base, worktreePath string, outputChan chan<- string) error {
+	worktreeBranch := strings.TrimPrefix(filepath.Base(worktreePath), r.opts.WorktreePrefix)
+
+	if _, err := r.runner.Run("show-ref", "--verify", "--quiet", "refs/heads/"+worktreeBranch); err == nil {
+		// Rebase the branch onto the default branch
+		if err := r.rebaseWorktree(worktreePath, worktreeBranch, base, outputChan); err != nil {
+			return err
+		}
+
+		// Checkout the branch in the worktree
+		return r.runGit(outputChan, "-C", worktreePath, "checkout", worktreeBranch)
+	}
+
+	// Branch doesn't exist, create and checkout in the worktree
+	return r.runGit(outputChan, "-C", worktreePath, "checkout", "-b", worktreeBranch, base)
+}
+
+func (r *repo) rebaseWorktree(worktreePath, branch, base string, outputChan chan<- string) error {
+	cmd := r.git("-C", worktreePath, "rebase", base, branch)
+	return r.runCommand(cmd, outputChan)
+}
+
+func (r *repo) rebasePoolBranch(branch, base string, outputChan chan<- string) error {
+	worktreePath, err := r.getWorktreePath(branch)
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkInProgress(worktreePath); err != nil {
+		return err
+	}
+
+	return r.rebaseWorktreePoolBranch(worktreePath, branch, base, outputChan)
+}
+
+// errUpToDate is returned when a pool branch already contains the base, so
+// there was nothing to rebase.
+var errUpToDate = errors.New("branch is already up to date")
+
+func (r *repo) rebaseWorktreePoolBranch(worktreePath, branch, base string, outputChan chan<- string) error {
+	// Nothing would change if the branch already contains the default branch,
+	// so avoid stashing and rebasing entirely
+	if _, err := r.runner.Run("merge-base", "--is-ancestor", base, branch); err == nil {
+		outputChan <- fmt.Sprintf("%s is already up to date with %s", branch, base)
+		return errUpToDate
+	}
+
+	// Check if worktree is dirty
+	isDirty, err := r.hasUncommittedChanges(worktreePath)
+	if err != nil {
+		return err
+	}
+
+	if isDirty {
+		switch r.opts.WorktreeDirtyPolicy {
+		case DirtySkip:
+			return errDirtyWorktree
+		case DirtyFail:
+			return fmt.Errorf("%s has uncommitted changes, commit or stash them first", worktreePath)
+		}
+	}
+
+	if r.opts.DryRun {
+		if err := r.planRebase(branch, base, isDirty); err != nil {
+			return err
+		}
+	}
+
+	var stashed string
+	if isDirty {
+		outputChan <- "Worktree is dirty, stashing changes..."
+		stashMessage := strings.NewReplacer("{branch}", branch, "{base}", base).Replace(r.stashMessage())
+		if stashed, err = r.pushStash(worktreePath, stashMessage, outputChan); err != nil {
+			return err
+		}
+
+		outputChan <- "Stashed changes"
+	}
+
+	// Perform rebase
+	outputChan <- fmt.Sprintf("Rebasing %s onto %s...", branch, base)
+	rebaseCmd := r.git("-C", worktreePath, "rebase", base, branch)
+	if err := r.runCommand(rebaseCmd, outputChan); err != nil {
+		// If rebase fails and we stashed changes, try to restore them
+		if isDirty {
+			outputChan <- "Rebase failed, restoring stashed changes..."
+			if unstashErr := r.popStashCommit(worktreePath, stashed, outputChan); unstashErr != nil {
+				outputChan <- fmt.Sprintf("Warning: failed to restore stashed changes: %v", unstashErr)
+			}
+		}
+
+		return err
+	}
+
+	// If rebase succeeded and we stashed changes, restore them
+	if isDirty {
+		outputChan <- "Rebase successful, restoring stashed changes..."
+		if err := r.popStashCommit(worktreePath, stashed, outputChan); err != nil {
+			if errors.Is(err, errStashConflict) {
+				return err
+			}
+
+			outputChan <- fmt.Sprintf("Warning: failed to restore stashed changes: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// planRebase records the commits that rebasing the branch would replay, to
+// show them at the end of a dry run.
+func (r *repo) planRebase(branch, base string, dirty bool) error {
+	output, err := r.runner.Run("log", "--oneline", "--no-decorate", base+".."+branch)
+	if err != nil {
+		return fmt.Errorf("failed to list the commits on %s: %w", branch, err)
+	}
+
+	plan := RebasePlan{Branch: branch, Base: base, Dirty: dirty}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			plan.Commits = append(plan.Commits, line)
+		}
+	}
+
+	r.planMu.Lock()
+	defer r.planMu.Unlock()
+
+	r.result.RebasePlans = append(r.result.RebasePlans, plan)
+	return nil
+}
+
+var errStashConflict = errors.New("stashed changes conflict")
+
+// errDirtyWorktree is returned for worktree pool branches with uncommitted
+// changes when they are skipped rather than stashed.
+var errDirtyWorktree = errors.New("worktree has uncommitted changes")
+
+// popStash restores the stash in the worktree. When the stashed changes
+// conflict, git keeps the stash, so the half-applied changes are rolled back
+// to leave the worktree clean with the stash still available.
+func (r *repo) popStash(worktreePath, ref string, outputChan chan<- string) error {
+	err := r.runGit(outputChan, "-C", worktreePath, "stash", "pop", ref)
+	if err == nil || !strings.Contains(err.Error(), "CONFLICT") {
+		return err
+	}
+
+	if _, resetErr := r.combinedOutput(r.git("-C", worktreePath, "reset", "--merge")); resetErr != nil {
+		outputChan <- fmt.Sprintf("Warning: failed to roll back conflicting stashed changes: %v", resetErr)
+	}
+
+	return fmt.Errorf("%w, they are preserved as %s: %v", errStashConflict, ref, err)
+}
+
+// hasUncommittedChanges reports whether the working tree has uncommitted
+// changes to tracked files. Untracked files are ignored as they survive
+// checkouts and rebases.
+func (r *repo) hasUncommittedChanges(dir string) (bool, error) {
+	output, err := r.runner.Run("-C", dir, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return false, err
+	}
+
+	return len(strings.TrimSpace(string(output))) > 0, nil
+}
@@ -0,0 +1,396 @@
+package cleanup
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeGit is a GitRunner answering git commands with canned output, keyed by
+// their arguments joined with spaces. Any other command fails.
+type fakeGit map[string]string
+
+func (f fakeGit) Run(args ...string) ([]byte, error) {
+	output, ok := f[strings.Join(args, " ")]
+	if !ok {
+		return nil, errors.New("unexpected command: git " + strings.Join(args, " "))
+	}
+
+	return []byte(output), nil
+}
+
+// branchesCommand is the command getBranches lists the local branches with.
+var branchesCommand = "for-each-ref --format=" + branchFormat + " refs/heads"
+
+// branchLine returns a line of getBranches' for-each-ref output.
+func branchLine(name, head, remote, track, worktree string) string {
+	return strings.Join([]string{name, head, remote, track, worktree, "1700000000", "sha-" + name}, "\x00") + "\n"
+}
+
+func TestGetBranches(t *testing.T) {
+	tests := []struct {
+		name string
+		refs []string
+		git  fakeGit
+		opts Options
+		want branchInfo
+	}{
+		{
+			name: "gone branch",
+			refs: []string{
+				branchLine("main", "*", "origin", "", "/src/app"),
+				branchLine("feature-a", "", "origin", "[gone]", ""),
+			},
+			git: fakeGit{"rev-list --count main..feature-a": "0\n"},
+			want: branchInfo{
+				DeletedBranches: []string{"feature-a"},
+				Reasons:         map[string]string{"feature-a": "gone from origin"},
+				GoneRemotes:     map[string]string{"feature-a": "origin"},
+				GoneSHAs:        map[string]string{"feature-a": "sha-feature-a"},
+			},
+		},
+		{
+			name: "branches that aren't gone",
+			refs: []string{
+				branchLine("main", "*", "origin", "", "/src/app"),
+				branchLine("behind", "", "origin", "[behind 2]", ""),
+				branchLine("local", "", "", "", ""),
+			},
+			want: branchInfo{
+				Reasons:     map[string]string{},
+				GoneRemotes: map[string]string{},
+				GoneSHAs:    map[string]string{},
+			},
+		},
+		{
+			name: "branch named like gone",
+			refs: []string{
+				branchLine("gone-fishing", "", "origin", "", ""),
+				branchLine("gone", "", "origin", "[ahead 1]", ""),
+			},
+			want: branchInfo{
+				Reasons:     map[string]string{},
+				GoneRemotes: map[string]string{},
+				GoneSHAs:    map[string]string{},
+			},
+		},
+		{
+			name: "gone branch named like gone",
+			refs: []string{
+				branchLine("gone-fishing", "", "origin", "[gone]", ""),
+			},
+			git: fakeGit{"rev-list --count main..gone-fishing": "0\n"},
+			want: branchInfo{
+				DeletedBranches: []string{"gone-fishing"},
+				Reasons:         map[string]string{"gone-fishing": "gone from origin"},
+				GoneRemotes:     map[string]string{"gone-fishing": "origin"},
+				GoneSHAs:        map[string]string{"gone-fishing": "sha-gone-fishing"},
+			},
+		},
+		{
+			name: "ahead and gone",
+			refs: []string{
+				branchLine("wip", "", "origin", "[gone]", ""),
+			},
+			git: fakeGit{"rev-list --count main..wip": "2\n"},
+			want: branchInfo{
+				UnmergedBranches: []unmergedBranch{{"wip", 2}},
+				Reasons:          map[string]string{},
+				GoneRemotes:      map[string]string{"wip": "origin"},
+				GoneSHAs:         map[string]string{"wip": "sha-wip"},
+			},
+		},
+		{
+			name: "ahead and gone with force",
+			refs: []string{
+				branchLine("wip", "", "origin", "[gone]", ""),
+			},
+			opts: Options{Force: true},
+			want: branchInfo{
+				DeletedBranches: []string{"wip"},
+				Reasons:         map[string]string{"wip": "gone from origin"},
+				GoneRemotes:     map[string]string{"wip": "origin"},
+				GoneSHAs:        map[string]string{"wip": "sha-wip"},
+			},
+		},
+		{
+			name: "gone from another remote",
+			refs: []string{
+				branchLine("fork-fix", "", "upstream", "[gone]", ""),
+			},
+			git: fakeGit{"rev-list --count main..fork-fix": "0\n"},
+			want: branchInfo{
+				DeletedBranches: []string{"fork-fix"},
+				Reasons:         map[string]string{"fork-fix": "gone from upstream"},
+				GoneRemotes:     map[string]string{"fork-fix": "upstream"},
+				GoneSHAs:        map[string]string{"fork-fix": "sha-fork-fix"},
+			},
+		},
+		{
+			name: "protected branch",
+			refs: []string{
+				branchLine("release/1", "", "origin", "[gone]", ""),
+			},
+			opts: Options{Protect: []string{"release/*"}},
+			want: branchInfo{
+				ProtectedBranches: []string{"release/1"},
+				Reasons:           map[string]string{},
+				GoneRemotes:       map[string]string{"release/1": "origin"},
+				GoneSHAs:          map[string]string{"release/1": "sha-release/1"},
+			},
+		},
+		{
+			name: "worktrees",
+			refs: []string{
+				branchLine("main", "*", "origin", "", "/src/app"),
+				branchLine("pool", "", "origin", "", "/src/web-pool"),
+				branchLine("feature-b", "", "origin", "[gone]", "/src/feature-b"),
+			},
+			git: fakeGit{"rev-list --count main..feature-b": "0\n"},
+			want: branchInfo{
+				DeletedBranches:      []string{"feature-b"},
+				WorktreeBranches:     []string{"feature-b"},
+				WorktreePoolBranches: []string{"pool"},
+				Reasons:              map[string]string{"feature-b": "gone from origin"},
+				GoneRemotes:          map[string]string{"feature-b": "origin"},
+				GoneSHAs:             map[string]string{"feature-b": "sha-feature-b"},
+			},
+		},
+		{
+			name: "malformed line",
+			refs: []string{"garbage\n"},
+			want: branchInfo{
+				Reasons:     map[string]string{},
+				GoneRemotes: map[string]string{},
+				GoneSHAs:    map[string]string{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			git := fakeGit{branchesCommand: strings.Join(tt.refs, "")}
+			for args, output := range tt.git {
+				git[args] = output
+			}
+
+			opts := tt.opts
+			opts.Git = git
+			opts.WorktreePrefix = "web-"
+
+			r := newRepo("/src/app", opts)
+			r.defaultBranch = "main"
+
+			got, err := r.getBranches()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getBranches() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDefaultBranch(t *testing.T) {
+	tests := []struct {
+		name    string
+		git     fakeGit
+		opts    Options
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "remote HEAD",
+			git:  fakeGit{"symbolic-ref refs/remotes/origin/HEAD": "refs/remotes/origin/main\n"},
+			want: "main",
+		},
+		{
+			name: "rev-parse",
+			git:  fakeGit{"rev-parse --abbrev-ref origin/HEAD": "origin/trunk\n"},
+			want: "trunk",
+		},
+		{
+			name: "init.defaultBranch",
+			git:  fakeGit{"config --get init.defaultBranch": "develop\n"},
+			want: "develop",
+		},
+		{
+			name: "detect order",
+			git: fakeGit{
+				"symbolic-ref refs/remotes/origin/HEAD": "refs/remotes/origin/main\n",
+				"config --get init.defaultBranch":       "develop\n",
+			},
+			opts: Options{DetectOrder: []string{"config", "symbolic-ref"}},
+			want: "develop",
+		},
+		{
+			name: "other remote",
+			git:  fakeGit{"symbolic-ref refs/remotes/upstream/HEAD": "refs/remotes/upstream/master\n"},
+			opts: Options{Remote: "upstream"},
+			want: "master",
+		},
+		{
+			name:    "empty output",
+			git:     fakeGit{"symbolic-ref refs/remotes/origin/HEAD": "\n"},
+			wantErr: true,
+		},
+		{
+			name:    "undetectable",
+			git:     fakeGit{},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Git = tt.git
+			if opts.Remote == "" {
+				opts.Remote = "origin"
+			}
+
+			got, err := newRepo("/src/app", opts).getDefaultBranch()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getDefaultBranch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("getDefaultBranch() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	// Keep the user's own config file out of the test
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	git := fakeGit{
+		"rev-parse --is-bare-repository --git-common-dir": "false\n/src/app/.git\n",
+		"rev-parse --show-toplevel":                       "/src/app\n",
+		"symbolic-ref refs/remotes/origin/HEAD":           "refs/remotes/origin/main\n",
+	}
+
+	got, err := DefaultBranch("/src/app", Options{Remote: "origin", NoCache: true, Git: git})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "main" {
+		t.Errorf("DefaultBranch() = %q, want %q", got, "main")
+	}
+}
+
+func TestGetWorktreePath(t *testing.T) {
+	root := t.TempDir()
+	main, extra, pool := filepath.Join(root, "app"), filepath.Join(root, "web-pool-extra"), filepath.Join(root, "web-pool")
+	for _, dir := range []string{main, extra, pool} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The worktree of a branch sharing a prefix is listed first
+	git := fakeGit{"worktree list --porcelain": strings.Join([]string{
+		"worktree " + main, "HEAD 1111111", "branch refs/heads/main", "",
+		"worktree " + extra, "HEAD 2222222", "branch refs/heads/pool-extra", "",
+		"worktree " + pool, "HEAD 3333333", "branch refs/heads/pool", "",
+	}, "\n")}
+
+	r := newRepo(main, Options{Git: git})
+	for branch, want := range map[string]string{"pool": pool, "pool-extra": extra, "main": main} {
+		got, err := r.getWorktreePath(branch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Errorf("getWorktreePath(%q) = %q, want %q", branch, got, want)
+		}
+	}
+
+	if _, err := r.getWorktreePath("poo"); err == nil {
+		t.Error("getWorktreePath(\"poo\") found a worktree of another branch")
+	}
+}
+
+// mustGit runs git in dir for a test, failing it if git does.
+func mustGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+
+	args = append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+	if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+}
+
+func TestGetRootDir(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Don't find the repository the temporary directory may be in
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(root))
+
+	app := filepath.Join(root, "app")
+	mustGit(t, root, "init", "--quiet", app)
+	mustGit(t, app, "commit", "--quiet", "--allow-empty", "-m", "init")
+	mustGit(t, app, "branch", "feature")
+	mustGit(t, app, "worktree", "add", "--quiet", filepath.Join(root, "app-feature"), "feature")
+
+	sub := filepath.Join(app, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	bare := filepath.Join(root, "bare.git")
+	mustGit(t, root, "clone", "--quiet", "--bare", app, bare)
+	mustGit(t, bare, "worktree", "add", "--quiet", filepath.Join(root, "bare-feature"), "feature")
+
+	tests := []struct {
+		name    string
+		dir     string
+		want    string
+		wantErr string
+	}{
+		{name: "normal repo", dir: app, want: app},
+		{name: "subdirectory", dir: sub, want: app},
+		{name: "linked worktree", dir: filepath.Join(root, "app-feature"), want: app},
+		{name: "bare repo", dir: bare, wantErr: "bare repositories have no working tree"},
+		{name: "worktree of a bare repo", dir: filepath.Join(root, "bare-feature"), want: filepath.Join(root, "bare-feature")},
+		{name: "not a repo", dir: root, wantErr: "not inside a git repository"},
+		{name: "missing directory", dir: filepath.Join(root, "missing"), wantErr: "directory does not exist"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getRootDir(dirRunner{"git", tt.dir}, tt.dir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("getRootDir() error = %v, want %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("getRootDir() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
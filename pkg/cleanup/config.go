@@ -0,0 +1,146 @@
+package cleanup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const configFileName = ".git-cleanup.yaml"
+
+// ignoreFileName lists branch patterns that are never deleted, one per line,
+// so they can be shared by everyone working on the repo.
+const ignoreFileName = ".git-cleanup-ignore"
+
+type config struct {
+	ProtectedBranches  []string `yaml:"protectedBranches"`
+	DefaultBranch      string   `yaml:"defaultBranch"`
+	WorktreeBase       string   `yaml:"worktreeBase"`
+	WorktreePoolPrefix *string  `yaml:"worktreePoolPrefix"`
+	WorktreePool       []string `yaml:"worktreePool"`
+	MaxRetries         *int     `yaml:"maxRetries"`
+}
+
+// getConfigPath returns the first config file that exists, checking the repo
+// root before falling back to the user's config directory.
+func getConfigPath(dir string) string {
+	paths := []string{filepath.Join(dir, configFileName)}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(homeDir, ".config")
+		}
+	}
+
+	if configHome != "" {
+		paths = append(paths, filepath.Join(configHome, "git-cleanup", "config.yaml"))
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	return ""
+}
+
+func loadConfig(dir string) (config, error) {
+	var cfg config
+
+	path := getConfigPath(dir)
+	if path == "" {
+		return cfg, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer file.Close()
+
+	// Reject unknown keys so a typo doesn't silently drop the setting
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	// A malformed pattern would match nothing, deleting the branches it was
+	// meant to protect
+	for _, pattern := range cfg.ProtectedBranches {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return cfg, fmt.Errorf("invalid pattern %q in protectedBranches of %s: %w", pattern, path, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// applyConfig copies config values into the options, leaving any options
+// explicitly set untouched.
+func applyConfig(cfg config, opts *Options) {
+	if len(cfg.ProtectedBranches) > 0 && !opts.changed("protect") {
+		opts.Protect = cfg.ProtectedBranches
+	}
+
+	if cfg.DefaultBranch != "" && !opts.changed("default-branch") {
+		opts.DefaultBranch = cfg.DefaultBranch
+	}
+
+	if cfg.WorktreeBase != "" && !opts.changed("worktree-base") {
+		opts.WorktreeBase = cfg.WorktreeBase
+	}
+
+	if cfg.WorktreePoolPrefix != nil && !opts.changed("worktree-prefix") {
+		opts.WorktreePrefix = *cfg.WorktreePoolPrefix
+	}
+
+	if len(cfg.WorktreePool) > 0 && !opts.changed("pool-branch") {
+		opts.PoolBranches = cfg.WorktreePool
+	}
+
+	if cfg.MaxRetries != nil && !opts.changed("max-retries") {
+		opts.MaxRetries = *cfg.MaxRetries
+	}
+}
+
+// loadIgnoreFile returns the branch patterns in the repo's ignore file,
+// skipping blank lines and # comments.
+func loadIgnoreFile(dir string) ([]string, error) {
+	file, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %w", err)
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if _, err := filepath.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %s: %w", line, ignoreFileName, err)
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %w", err)
+	}
+
+	return patterns, nil
+}
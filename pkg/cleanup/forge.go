@@ -0,0 +1,133 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// forgeTimeout is how long to wait for a forge's API to respond.
+const forgeTimeout = 10 * time.Second
+
+// forge describes how to ask a hosting service for a repo's default branch.
+type forge struct {
+	// apiURL returns the API URL describing the repo at the given path
+	apiURL func(path string) string
+	// tokenEnv is the environment variable holding a token for private repos
+	tokenEnv string
+	// setToken adds the token to the request
+	setToken func(req *http.Request, token string)
+}
+
+// forges are the hosting services whose API can be asked for the default
+// branch, by host name.
+var forges = map[string]forge{
+	"github.com": {
+		apiURL: func(path string) string {
+			return "https://api.github.com/repos/" + path
+		},
+		tokenEnv: "GITHUB_TOKEN",
+		setToken: func(req *http.Request, token string) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		},
+	},
+	"gitlab.com": {
+		apiURL: func(path string) string {
+			return "https://gitlab.com/api/v4/projects/" + url.PathEscape(path)
+		},
+		tokenEnv: "GITLAB_TOKEN",
+		setToken: func(req *http.Request, token string) {
+			req.Header.Set("PRIVATE-TOKEN", token)
+		},
+	},
+}
+
+// parseRemoteURL returns the host and repo path of a remote URL, accepting
+// both URLs and the scp-like syntax used for SSH remotes.
+func parseRemoteURL(remoteURL string) (host, path string, ok bool) {
+	if !strings.Contains(remoteURL, "://") {
+		// git@github.com:owner/repo.git
+		userHost, repoPath, found := strings.Cut(remoteURL, ":")
+		if !found {
+			return "", "", false
+		}
+
+		_, host, _ = strings.Cut(userHost, "@")
+		if host == "" {
+			host = userHost
+		}
+
+		path = repoPath
+	} else {
+		u, err := url.Parse(remoteURL)
+		if err != nil {
+			return "", "", false
+		}
+
+		host, path = u.Hostname(), u.Path
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return host, path, host != "" && path != ""
+}
+
+// getForgeDefaultBranch asks the forge hosting the remote for the repo's
+// default branch.
+func (r *repo) getForgeDefaultBranch() (string, error) {
+	remoteURL, err := r.remoteURL(r.opts.Remote)
+	if err != nil {
+		return "", err
+	}
+
+	host, path, ok := parseRemoteURL(remoteURL)
+	if !ok {
+		return "", fmt.Errorf("unrecognized remote URL %s", remoteURL)
+	}
+
+	if len(r.opts.AllowHosts) > 0 && !r.isAllowedHost(host) {
+		return "", fmt.Errorf("refusing to query %s, it is not an allowed host", host)
+	}
+
+	f, ok := forges[host]
+	if !ok {
+		return "", fmt.Errorf("%s is not a supported forge", host)
+	}
+
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, f.apiURL(path), nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if token := os.Getenv(f.tokenEnv); token != "" {
+		f.setToken(req, token)
+	}
+
+	client := &http.Client{Timeout: forgeTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to query %s: %w", host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to query %s: %s (set %s for private repos)", host, resp.Status, f.tokenEnv)
+	}
+
+	var body struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to parse response from %s: %w", host, err)
+	}
+
+	if body.DefaultBranch == "" {
+		return "", fmt.Errorf("%s did not return a default branch", host)
+	}
+
+	return body.DefaultBranch, nil
+}
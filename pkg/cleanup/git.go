@@ -0,0 +1,304 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mskelton/git-cleanup/pkg/streamer"
+)
+
+const (
+	maxRetryDelay = 30 * time.Second
+
+	// waitDelay is how long to wait for the output of a killed git command,
+	// which may never close if git spawned processes of its own
+	waitDelay = time.Second
+)
+
+// Errors that indicate a transient ref locking issue, typically caused by
+// another git process touching the same refs at the same time.
+var retryPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`cannot lock ref`),
+	regexp.MustCompile(`unable to update local ref`),
+	regexp.MustCompile(`\.lock': File exists`),
+	regexp.MustCompile(`is at [0-9a-f]+ but expected [0-9a-f]+`),
+}
+
+// Errors that retrying won't fix, which take precedence over retryPatterns as
+// a failed fetch can report both.
+var fatalPatterns = []string{
+	"Authentication failed",
+	"Permission denied",
+	"could not read Username",
+	"terminal prompts disabled",
+	"Could not read from remote repository",
+	"not a git repository",
+}
+
+// GitRunner runs git commands in a repository, returning their output. It
+// is used to inspect the repository, so a fake can be injected to exercise the
+// parsing logic without a real repository.
+type GitRunner interface {
+	Run(args ...string) ([]byte, error)
+}
+
+// execRunner is the GitRunner that shells out to git.
+type execRunner struct {
+	repo *repo
+}
+
+func (e execRunner) Run(args ...string) ([]byte, error) {
+	start := time.Now()
+	output, err := e.repo.git(args...).Output()
+	logGit(args, start, err)
+	return output, err
+}
+
+// dirRunner is the GitRunner that shells out to git in a directory, used to
+// find the repository containing it before there is a repo to inspect.
+type dirRunner struct {
+	git string
+	dir string
+}
+
+func (d dirRunner) Run(args ...string) ([]byte, error) {
+	start := time.Now()
+	output, err := exec.Command(d.git, append([]string{"-C", d.dir}, args...)...).Output()
+	logGit(args, start, err)
+	return output, err
+}
+
+// runnerIn returns the options' git runner, or the one shelling out to git in
+// dir if there is none.
+func (o Options) runnerIn(dir string) GitRunner {
+	if o.Git != nil {
+		return o.Git
+	}
+
+	return dirRunner{o.gitBinary(), dir}
+}
+
+// newRepo returns the repo in dir, inspected with the options' git runner or
+// by shelling out to git if there is none.
+func newRepo(dir string, opts Options) *repo {
+	r := &repo{dir: dir, opts: opts, ctx: context.Background(), runner: opts.Git}
+	if r.runner == nil {
+		r.runner = execRunner{r}
+	}
+
+	seed := opts.RetrySeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	r.rand = rand.New(rand.NewSource(seed))
+
+	return r
+}
+
+func (r *repo) git(args ...string) *exec.Cmd {
+	return r.gitContext(r.ctx, args...)
+}
+
+// gitContext builds a git command in the repo that is killed once the context
+// is done.
+func (r *repo) gitContext(ctx context.Context, args ...string) *exec.Cmd {
+	if !slices.Contains(args, "-C") {
+		args = append([]string{"-C", r.dir}, args...)
+	}
+
+	cmd := exec.CommandContext(ctx, r.opts.gitBinary(), args...)
+	cmd.WaitDelay = waitDelay
+
+	// A credential prompt would hang behind the spinner, so fail instead
+	if !r.opts.AllowPrompt {
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	}
+
+	return cmd
+}
+
+// runGit runs a git command, retrying with exponential backoff when it fails
+// due to a ref locking issue or takes longer than the timeout.
+func (r *repo) runGit(outputChan chan<- string, args ...string) error {
+	if r.dryRun(r.git(args...)) {
+		return nil
+	}
+
+	ctx := r.ctx
+	cancel := context.CancelFunc(func() {})
+	defer func() { cancel() }()
+
+	// Each attempt gets the full timeout
+	var attempt int
+	var start time.Time
+	newCmd := func() *exec.Cmd {
+		cancel()
+		ctx, cancel = r.timeoutContext()
+		attempt++
+		start = time.Now()
+		return r.gitContext(ctx, args...)
+	}
+
+	err := streamer.RunCommandWithRetry(newCmd, outputChan, streamer.RetryPolicy{
+		MaxRetries: r.opts.MaxRetries,
+		Backoff:    r.retryBackoff,
+		Context:    r.ctx,
+		ShouldRetry: func(output string) bool {
+			retry := errors.Is(ctx.Err(), context.DeadlineExceeded) || shouldRetry(output)
+			if retry {
+				logGit(args, start, errors.New(output))
+				slog.Info("retrying git command", "args", args, "attempt", attempt)
+			}
+
+			return retry
+		},
+	})
+	logGit(args, start, err)
+
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", r.opts.Timeout)
+	}
+
+	if err != nil && strings.Contains(err.Error(), "terminal prompts disabled") {
+		return fmt.Errorf("%w\ncredentials are required, cache them or pass --allow-prompt to be asked for them", err)
+	}
+
+	return err
+}
+
+// runCommand runs a command through the streamer, logging it once it
+// finishes.
+func (r *repo) runCommand(cmd *exec.Cmd, outputChan chan<- string) error {
+	if r.dryRun(cmd) {
+		return nil
+	}
+
+	start := time.Now()
+	err := streamer.RunCommand(cmd, outputChan)
+	logGit(cmd.Args[1:], start, err)
+	return err
+}
+
+// combinedOutput runs a git command and returns its combined output, logging
+// it once it finishes.
+func (r *repo) combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	if r.dryRun(cmd) {
+		return nil, nil
+	}
+
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	logGit(cmd.Args[1:], start, err)
+	return output, err
+}
+
+// dryRun records a command that changes the repo to be explained, returning
+// whether it should be skipped as this is a dry run.
+func (r *repo) dryRun(cmd *exec.Cmd) bool {
+	if r.opts.Explain {
+		line := shellJoin(cmd.Args)
+		if cmd.Dir != "" {
+			line = "cd " + shellQuote(cmd.Dir) + " && " + line
+		}
+
+		r.explainMu.Lock()
+		r.explained = append(r.explained, line)
+		r.explainMu.Unlock()
+	}
+
+	return r.opts.DryRun
+}
+
+// shellJoin joins the arguments into a command line that can be pasted into a
+// shell.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote single quotes the argument if the shell would otherwise
+// interpret it.
+func shellQuote(arg string) string {
+	safe := func(r rune) bool {
+		return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%_+=:,./-", r)
+	}
+
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool { return !safe(r) }) == -1 {
+		return arg
+	}
+
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// logGit logs a git command that has finished running.
+func logGit(args []string, start time.Time, err error) {
+	attrs := []any{"args", args, "duration", time.Since(start).Round(time.Millisecond)}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+
+	slog.Debug("git", attrs...)
+}
+
+// timeoutContext returns a context that expires after the timeout, if one is
+// set.
+func (r *repo) timeoutContext() (context.Context, context.CancelFunc) {
+	if r.opts.Timeout <= 0 {
+		return context.WithCancel(r.ctx)
+	}
+
+	return context.WithTimeout(r.ctx, r.opts.Timeout)
+}
+
+// shouldRetry reports whether the output of a failed git command indicates a
+// transient failure.
+func shouldRetry(output string) bool {
+	for _, pattern := range fatalPatterns {
+		if strings.Contains(output, pattern) {
+			return false
+		}
+	}
+
+	for _, pattern := range retryPatterns {
+		if pattern.MatchString(output) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryBackoff returns the delay before the retry attempt, doubling the retry
+// delay after each attempt. The delay is jittered by up to half either way so
+// that commands which collided on a ref lock don't retry in lockstep.
+func (r *repo) retryBackoff(attempt int) time.Duration {
+	if r.opts.RetryDelay <= 0 {
+		return 0
+	}
+
+	// Doubling too many times overflows, losing the bits shifted out
+	delay := r.opts.RetryDelay << attempt
+	if attempt >= 63 || delay>>attempt != r.opts.RetryDelay || delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+
+	r.randMu.Lock()
+	jitter := 0.5 + r.rand.Float64()
+	r.randMu.Unlock()
+
+	return min(time.Duration(float64(delay)*jitter), maxRetryDelay)
+}
@@ -0,0 +1,105 @@
+package cleanup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{
+			name:   "locked ref",
+			output: "error: cannot lock ref 'refs/remotes/origin/main': Unable to create '/src/app/.git/refs/remotes/origin/main.lock': File exists.",
+			want:   true,
+		},
+		{
+			name:   "ref not updated",
+			output: " ! [new branch]      feature    -> origin/feature  (unable to update local ref)",
+			want:   true,
+		},
+		{
+			name:   "locked index",
+			output: "fatal: Unable to create '/src/app/.git/index.lock': File exists.",
+			want:   true,
+		},
+		{
+			name:   "ref moved",
+			output: "error: cannot lock ref 'refs/heads/main': is at 3f786850e387550fdab836ed7e6dc881de23001b but expected 89e6c98d92887913cadf06b2adb97f26cde4849b",
+			want:   true,
+		},
+		{
+			name:   "ref moved without the lock failure",
+			output: "'refs/remotes/origin/main' is at 3f78685 but expected 89e6c98",
+			want:   true,
+		},
+		{
+			name:   "authentication",
+			output: "remote: Invalid username or password.\nfatal: Authentication failed for 'https://github.com/owner/repo.git/'",
+		},
+		{
+			name:   "ssh key",
+			output: "git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.",
+		},
+		{
+			name:   "credential prompt",
+			output: "fatal: could not read Username for 'https://github.com': terminal prompts disabled",
+		},
+		{
+			name:   "missing repository",
+			output: "fatal: '/nonexistent' does not appear to be a git repository\nfatal: Could not read from remote repository.",
+		},
+		{
+			name:   "not a repository",
+			output: "fatal: not a git repository (or any of the parent directories): .git",
+		},
+		{
+			name:   "lock failure reported with an auth failure",
+			output: "error: cannot lock ref 'refs/remotes/origin/main'\nfatal: Authentication failed for 'https://github.com/owner/repo.git/'",
+		},
+		{
+			name:   "remote-tracking ref without a lock failure",
+			output: "error: refs/remotes/origin/feature does not point to a valid object!",
+		},
+		{
+			name:   "diverged",
+			output: "fatal: Not possible to fast-forward, aborting.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldRetry(tt.output); got != tt.want {
+				t.Errorf("shouldRetry(%q) = %v, want %v", tt.output, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		attempt  int
+		min, max time.Duration
+	}{
+		{name: "no delay", delay: 0, attempt: 3, min: 0, max: 0},
+		{name: "first retry", delay: 2 * time.Second, attempt: 0, min: time.Second, max: 3 * time.Second},
+		{name: "doubled", delay: 2 * time.Second, attempt: 2, min: 4 * time.Second, max: 12 * time.Second},
+		{name: "capped", delay: 2 * time.Second, attempt: 10, min: maxRetryDelay, max: maxRetryDelay},
+		{name: "overflow", delay: 2 * time.Second, attempt: 40, min: maxRetryDelay, max: maxRetryDelay},
+		{name: "shifted out", delay: 2 * time.Second, attempt: 80, min: maxRetryDelay, max: maxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRepo("/src/app", Options{RetryDelay: tt.delay, RetrySeed: 1})
+			if got := r.retryBackoff(tt.attempt); got < tt.min || got > tt.max {
+				t.Errorf("retryBackoff(%d) = %s, want between %s and %s", tt.attempt, got, tt.min, tt.max)
+			}
+		})
+	}
+}
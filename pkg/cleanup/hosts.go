@@ -0,0 +1,52 @@
+package cleanup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// remoteURL returns the URL git fetches the remote from.
+func (r *repo) remoteURL(remote string) (string, error) {
+	output, err := r.runner.Run("remote", "get-url", remote)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the URL of %s: %w", remote, err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// checkAllowedHosts refuses to contact the remotes unless each of them is on
+// one of the allowed hosts, when any are given.
+func (r *repo) checkAllowedHosts(remotes ...string) error {
+	if len(r.opts.AllowHosts) == 0 {
+		return nil
+	}
+
+	for _, remote := range remotes {
+		remoteURL, err := r.remoteURL(remote)
+		if err != nil {
+			return err
+		}
+
+		host, _, ok := parseRemoteURL(remoteURL)
+		if !ok {
+			return fmt.Errorf("refusing to contact %s, the host of %s is unknown (allowed hosts: %s)", remote, remoteURL, strings.Join(r.opts.AllowHosts, ", "))
+		}
+
+		if !r.isAllowedHost(host) {
+			return fmt.Errorf("refusing to contact %s, %s is not an allowed host (allowed hosts: %s)", remote, host, strings.Join(r.opts.AllowHosts, ", "))
+		}
+	}
+
+	return nil
+}
+
+func (r *repo) isAllowedHost(host string) bool {
+	for _, allowed := range r.opts.AllowHosts {
+		if strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,131 @@
+package cleanup
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+)
+
+// openRepo returns the repo containing dir with its config file applied,
+// without cleaning anything up.
+func openRepo(dir string, opts Options) (*repo, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	rootDir, err := getRootDir(opts.runnerIn(dir), dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := loadConfig(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ignored, err := loadIgnoreFile(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRepo(rootDir, opts)
+	applyConfig(cfg, &r.opts)
+
+	// Branches in the ignore file are protected on top of any others, as the
+	// file is shared rather than a personal preference
+	r.opts.Protect = append(slices.Clip(r.opts.Protect), ignored...)
+
+	if toplevel, _ := gitLines(opts.runnerIn(dir), "rev-parse", "--show-toplevel"); len(toplevel) > 0 && toplevel[0] != rootDir {
+		r.currentWorktree = toplevel[0]
+	}
+
+	return r, nil
+}
+
+// DefaultBranch returns the default branch a cleanup of the repo containing
+// dir would use, either from the options and config file or detected from the
+// remote.
+func DefaultBranch(dir string, opts Options) (string, error) {
+	r, err := openRepo(dir, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if r.opts.DefaultBranch != "" {
+		return r.opts.DefaultBranch, nil
+	}
+
+	return r.cachedDefaultBranch(r.getDefaultBranch)
+}
+
+// Status prints how each branch of the repo containing dir would be handled by
+// a cleanup, without changing anything.
+func Status(dir string, opts Options) error {
+	r, err := openRepo(dir, opts)
+	if err != nil {
+		return err
+	}
+
+	if ok, err := r.prepare(); !ok || err != nil {
+		return err
+	}
+
+	branches, err := r.getBranches()
+	if err != nil {
+		return fmt.Errorf("error getting deleted branches: %w", err)
+	}
+
+	type row struct{ branch, action, reason string }
+	var rows []row
+
+	for _, branch := range branches.DeletedBranches {
+		reason := branches.Reasons[branch]
+		switch {
+		case branch == r.currentBranch:
+			rows = append(rows, row{branch, "keep", "current branch"})
+		case slices.Contains(branches.WorktreeBranches, branch):
+			rows = append(rows, row{branch, "reset worktree and delete", reason})
+		default:
+			rows = append(rows, row{branch, "delete", reason})
+		}
+	}
+
+	for _, branch := range branches.OldBranches {
+		days := int(branch.Age.Hours() / 24)
+		rows = append(rows, row{branch.Name, "ask", fmt.Sprintf("last updated %d %s ago", days, plural(days, "day", "days"))})
+	}
+
+	for _, branch := range branches.WorktreePoolBranches {
+		rows = append(rows, row{branch, "rebase", "worktree pool"})
+	}
+
+	for _, branch := range branches.ProtectedBranches {
+		rows = append(rows, row{branch, "keep", "protected"})
+	}
+
+	for _, branch := range branches.RecentBranches {
+		rows = append(rows, row{branch, "keep", "recently updated"})
+	}
+
+	for _, branch := range branches.UnmergedBranches {
+		rows = append(rows, row{branch.Name, "keep", fmt.Sprintf("%d unmerged %s", branch.Commits, plural(branch.Commits, "commit", "commits"))})
+	}
+
+	if branch := branches.CurrentWorktreeBranch; branch != "" {
+		rows = append(rows, row{branch, "keep", "checked out in the current worktree"})
+	}
+
+	if len(rows) == 0 {
+		fmt.Println("No branches to clean up")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BRANCH\tACTION\tREASON")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", row.branch, row.action, row.reason)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,34 @@
+package cleanup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// lockName is the file in the git directory locked while a cleanup runs.
+const lockName = "git-cleanup.lock"
+
+var errLocked = errors.New("another git-cleanup is running in this repository")
+
+// lock takes the repo's lock so that concurrent cleanups don't race on the
+// same refs, returning a function that releases it.
+func (r *repo) lock() (func(), error) {
+	path, err := r.gitPath(lockName)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// The lock is released when the file is closed, or when the process exits
+	return func() { file.Close() }, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package cleanup
+
+import "os"
+
+// lockFile is a no-op where advisory locks aren't supported, so concurrent
+// cleanups fall back to retrying ref locking failures.
+func lockFile(file *os.File) error {
+	return nil
+}
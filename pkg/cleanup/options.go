@@ -0,0 +1,235 @@
+package cleanup
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultStashMessage is the message of stashes made before rebasing the
+// worktree pool.
+const DefaultStashMessage = "Auto-stash before rebase {branch} onto {base}"
+
+// How a cleanup handles failures, see Options.OnError.
+const (
+	OnErrorContinue = "continue"
+	OnErrorAbort    = "abort"
+)
+
+// OnErrorPolicies are the values accepted by Options.OnError.
+var OnErrorPolicies = []string{OnErrorContinue, OnErrorAbort}
+
+// How dirty worktree pool worktrees are handled, see
+// Options.WorktreeDirtyPolicy.
+const (
+	DirtyStash = "stash"
+	DirtySkip  = "skip"
+	DirtyFail  = "fail"
+)
+
+// DirtyPolicies are the values accepted by Options.WorktreeDirtyPolicy.
+var DirtyPolicies = []string{DirtyStash, DirtySkip, DirtyFail}
+
+// Mode selects which parts of the cleanup are run.
+type Mode int
+
+const (
+	// ModeFull updates the default branch, deletes gone branches, and
+	// refreshes worktrees
+	ModeFull Mode = iota
+	// ModeWorktrees resets worktrees of gone branches and rebases the worktree
+	// pool, without deleting any branches
+	ModeWorktrees
+	// ModeBranches prunes and deletes gone branches without touching any
+	// worktrees
+	ModeBranches
+	// ModePool pulls the default branch and rebases the worktree pool onto it
+	ModePool
+	// ModeLocal deletes branches without an upstream that are fully merged
+	// into the default branch
+	ModeLocal
+)
+
+// Options controls how repositories are cleaned up. Values from each
+// repository's config file are applied on top of them, unless Changed reports
+// the option was set explicitly.
+type Options struct {
+	// Dirs are the repositories to clean, defaulting to the working directory
+	Dirs []string
+	Mode Mode
+
+	Remote string
+	// AllowHosts are the only hosts remotes are fetched and pulled from, when
+	// there are any
+	AllowHosts []string
+	Protect    []string
+	// Include limits the branches that are deleted to those matching one of
+	// these patterns, when there are any
+	Include        []string
+	WorktreePrefix string
+	// PoolBranches are the branches of the worktree pool, whose worktrees are
+	// created when they are missing
+	PoolBranches  []string
+	DefaultBranch string
+	// WorktreeBase is the branch worktrees are reset and rebased onto,
+	// defaulting to the default branch that is pulled
+	WorktreeBase string
+	// DetectOrder are the DetectMethods tried in order to detect the default
+	// branch when it isn't set, defaulting to all of them
+	DetectOrder []string
+	// NoCache detects the default branch every time instead of reusing the
+	// one detected by an earlier run
+	NoCache bool
+	// ForgeDefault asks GitHub or GitLab for the default branch when it can't
+	// be detected from the local refs
+	ForgeDefault bool
+	Jobs         int
+	// MaxParallelWorktrees is the number of worktree pool branches rebased at
+	// once, rebasing one at a time when less than two
+	MaxParallelWorktrees int
+	MaxRetries           int
+	RetryDelay           time.Duration
+	// RetrySeed seeds the jitter added to retry delays so they can be
+	// reproduced, using a random seed when zero
+	RetrySeed   int64
+	Timeout     time.Duration
+	Autostash   bool
+	NoPull      bool
+	NoFetch     bool
+	Interactive bool
+	KeepCurrent bool
+	AllowPrompt bool
+	Force       bool
+	// PruneEmptyWorktreeDirs removes the empty directories of pruned worktrees
+	// and pool branches named with the worktree prefix that are no longer
+	// registered worktrees
+	PruneEmptyWorktreeDirs bool
+	// FetchAll fetches and prunes every remote, rather than only the remotes
+	// local branches track
+	FetchAll bool
+	// PruneMerged deletes branches fully merged into the default branch, even
+	// when their remote branch still exists
+	PruneMerged bool
+	// DeleteSquashed deletes branches whose changes were squash merged into
+	// the default branch, even when their remote branch still exists
+	DeleteSquashed bool
+	// ExcludeCurrentWorktree leaves the worktree git-cleanup is run from alone
+	ExcludeCurrentWorktree bool
+	// Since keeps gone branches with commits newer than this
+	Since time.Duration
+	// MaxBranchAge asks before deleting gone branches with no commits newer
+	// than this, or skips them when there is no terminal to ask in
+	MaxBranchAge time.Duration
+	PostHook     string
+	ReportFile   string
+	PullRebase   bool
+	FFOnly       bool
+	// VerifySignature refuses to clean up unless the commit the default branch
+	// points to has a valid signature
+	VerifySignature bool
+	// RecurseSubmodules also deletes gone branches in each submodule
+	RecurseSubmodules bool
+	// Verify checks every branch meant to be deleted is gone afterwards
+	Verify bool
+	// DryRun shows what would be cleaned up without changing anything
+	DryRun bool
+	// Explain prints every command that changes the repo, or would in a dry
+	// run, so they can be run by hand
+	Explain bool
+	// WorktreeDirtyPolicy is what is done with uncommitted changes in the
+	// worktree pool before rebasing, either DirtyStash to stash and restore
+	// them, DirtySkip to leave the worktree alone, or DirtyFail to fail its
+	// rebase. Defaults to stashing.
+	WorktreeDirtyPolicy string
+	// StashMessage is the message of stashes made before rebasing the worktree
+	// pool, where {branch} and {base} are replaced by the branch being rebased
+	// and the branch it's rebased onto. Defaults to DefaultStashMessage.
+	StashMessage string
+	// RecoverStashes restores the stashes left behind by earlier cleanups
+	// instead of only warning about them
+	RecoverStashes bool
+	// PruneRemoteTracking also runs git remote prune after fetching, to remove
+	// remote-tracking refs an interrupted fetch left behind
+	PruneRemoteTracking bool
+	// PruneTags deletes local tags that have been deleted from the remote
+	PruneTags bool
+	// OnError is OnErrorContinue to carry on with the rest of the cleanup when
+	// something fails, or OnErrorAbort to stop at the first failure. Defaults
+	// to continuing.
+	OnError string
+	// Only runs just these phases, while Skip runs every phase but these
+	Only []string
+	Skip []string
+
+	// GitPath is the git binary to run, defaulting to git on the PATH
+	GitPath string
+	// Git runs the git commands used to find and inspect repositories,
+	// shelling out to git when nil
+	Git GitRunner
+
+	// Changed reports whether the option with the given flag name was set
+	// explicitly, in which case it takes precedence over the config file. When
+	// nil, the config file always takes precedence.
+	Changed func(flag string) bool
+}
+
+// changed reports whether the option was set explicitly.
+func (o Options) changed(flag string) bool {
+	return o.Changed != nil && o.Changed(flag)
+}
+
+// gitBinary returns the git binary to run.
+func (o Options) gitBinary() string {
+	if o.GitPath == "" {
+		return "git"
+	}
+
+	return o.GitPath
+}
+
+// validate returns an error if any of the options name something that doesn't
+// exist.
+func (o Options) validate() error {
+	if o.GitPath != "" {
+		if _, err := exec.LookPath(o.GitPath); err != nil {
+			return fmt.Errorf("invalid git path: %w", err)
+		}
+	}
+
+	for _, phases := range [][]string{o.Only, o.Skip} {
+		if err := validatePhases(phases); err != nil {
+			return err
+		}
+	}
+
+	if o.OnError != "" && !slices.Contains(OnErrorPolicies, o.OnError) {
+		return fmt.Errorf("unknown error policy %q, use one of %s", o.OnError, strings.Join(OnErrorPolicies, ", "))
+	}
+
+	if o.WorktreeDirtyPolicy != "" && !slices.Contains(DirtyPolicies, o.WorktreeDirtyPolicy) {
+		return fmt.Errorf("unknown worktree dirty policy %q, use one of %s", o.WorktreeDirtyPolicy, strings.Join(DirtyPolicies, ", "))
+	}
+
+	for _, pattern := range o.Include {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+		}
+	}
+
+	for _, pattern := range o.Protect {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid protect pattern %q: %w", pattern, err)
+		}
+	}
+
+	for _, method := range o.DetectOrder {
+		if !slices.Contains(DetectMethods, method) {
+			return fmt.Errorf("unknown default branch detection method %q, use one of %s", method, strings.Join(DetectMethods, ", "))
+		}
+	}
+
+	return nil
+}
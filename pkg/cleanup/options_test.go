@@ -0,0 +1,45 @@
+package cleanup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidatePatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "valid", opts: Options{Include: []string{"dependabot/*"}, Protect: []string{"release/*"}}},
+		{name: "malformed include", opts: Options{Include: []string{"dependabot/["}}, wantErr: true},
+		{name: "malformed protect", opts: Options{Protect: []string{"release/["}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMalformedProtect(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, configFileName), []byte("protectedBranches:\n  - release/[\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadConfig(dir); err == nil {
+		t.Error("loadConfig() error = nil, want the malformed pattern to be rejected")
+	}
+}
+
+func TestIsProtectedMalformedPattern(t *testing.T) {
+	r := newRepo("/src/app", Options{Protect: []string{"release/["}})
+	if !r.isProtected("release/1") {
+		t.Error("isProtected() = false, want a malformed pattern to protect the branch")
+	}
+}
@@ -0,0 +1,23 @@
+package cleanup
+
+import (
+	"github.com/fatih/color"
+	"github.com/mskelton/git-cleanup/pkg/streamer"
+)
+
+// warn prints a notice about something that was skipped or needs attention,
+// unless running quietly.
+func warn(format string, a ...any) {
+	if !streamer.Quiet {
+		streamer.Above(func() { color.Yellow(format, a...) })
+	}
+}
+
+// plural returns the singular or plural form of a word to match the count.
+func plural(count int, singular, plural string) string {
+	if count == 1 {
+		return singular
+	}
+
+	return plural
+}
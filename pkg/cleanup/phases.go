@@ -0,0 +1,159 @@
+package cleanup
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// Phases of a cleanup that can be selected with Options.Only and Options.Skip.
+const (
+	PhaseCheckout      = "checkout"
+	PhasePull          = "pull"
+	PhasePrune         = "prune"
+	PhasePruneTags     = "prune-tags"
+	PhaseWorktreePrune = "worktree-prune"
+	PhaseWorktreeReset = "worktree-reset"
+	PhaseDelete        = "delete"
+	PhasePoolRebase    = "pool-rebase"
+	PhasePostHook      = "post-hook"
+)
+
+// Phases lists every phase in the order they run.
+var Phases = []string{
+	PhaseCheckout,
+	PhasePull,
+	PhasePrune,
+	PhasePruneTags,
+	PhaseWorktreePrune,
+	PhaseWorktreeReset,
+	PhaseDelete,
+	PhasePoolRebase,
+	PhasePostHook,
+}
+
+// Phases of a cleanup that always run, as the phases after them depend on
+// them, so they can't be selected. Errors are still reported with their name.
+const (
+	PhaseVerifySignature = "verify-signature"
+	PhaseClassify        = "classify"
+	PhaseConfirm         = "confirm"
+	PhaseVerify          = "verify"
+)
+
+// PhaseError is an error that happened while running a phase.
+type PhaseError struct {
+	Phase string
+	Err   error
+}
+
+func (e *PhaseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// step is a single step of a cleanup.
+type step struct {
+	// phase names the step, which can be selected by it unless it's one of
+	// the phases that always run
+	phase string
+	run   func() error
+}
+
+// prerequisite reports whether the steps after this one depend on it, so its
+// failure aborts the cleanup whatever Options.OnError is. Pulling into any
+// branch but the default branch would merge it, so the checkout is one too.
+func (s step) prerequisite() bool {
+	return !s.selectable() || s.phase == PhaseCheckout
+}
+
+// selectable reports whether the step can be selected with Options.Only and
+// Options.Skip, rather than always running.
+func (s step) selectable() bool {
+	return slices.Contains(Phases, s.phase)
+}
+
+// runSteps runs each of the selected steps in order, then finishes the
+// cleanup. When a phase fails, the cleanup continues with the next one or
+// stops depending on Options.OnError, while a failed prerequisite always
+// aborts it before finishing.
+func (r *repo) runSteps(steps []step) error {
+	for _, s := range steps {
+		if s.selectable() && !r.opts.runsPhase(s.phase) {
+			slog.Debug("skipping phase", "phase", s.phase)
+			continue
+		}
+
+		errCount := len(r.errs)
+		err := s.run()
+
+		// Record which phase each of its errors came from
+		for i := errCount; i < len(r.errs); i++ {
+			r.errs[i] = &PhaseError{s.phase, r.errs[i]}
+		}
+
+		if err != nil {
+			err = &PhaseError{s.phase, err}
+		}
+
+		if err != nil && s.prerequisite() {
+			r.result.FailedOperations = append(r.result.FailedOperations, s.phase)
+
+			// What ran before the abort is still reported
+			return r.finish(err)
+		} else if err != nil {
+			r.result.FailedOperations = append(r.result.FailedOperations, s.phase)
+			r.errs = append(r.errs, err)
+		}
+
+		if r.abortOnError() && len(r.errs) > errCount {
+			slog.Debug("aborting after failed phase", "phase", s.phase)
+			break
+		}
+
+		// Stop as soon as the cleanup is canceled
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	return r.finish(nil)
+}
+
+// abortOnError reports whether the cleanup stops at the first failure.
+func (r *repo) abortOnError() bool {
+	return r.opts.OnError == OnErrorAbort
+}
+
+// infallible adapts a step that records its errors rather than stopping the
+// cleanup.
+func infallible(run func()) func() error {
+	return func() error {
+		run()
+		return nil
+	}
+}
+
+// runsPhase reports whether the phase was selected to run.
+func (o Options) runsPhase(phase string) bool {
+	if len(o.Only) > 0 && !slices.Contains(o.Only, phase) {
+		return false
+	}
+
+	return !slices.Contains(o.Skip, phase)
+}
+
+// validatePhases returns an error if any of the phases don't exist.
+func validatePhases(phases []string) error {
+	for _, phase := range phases {
+		if !slices.Contains(Phases, phase) {
+			return fmt.Errorf("unknown phase %q, use one of %s", phase, strings.Join(Phases, ", "))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunStepsPrerequisiteFailure(t *testing.T) {
+	reportFile := filepath.Join(t.TempDir(), "report.jsonl")
+	r := newRepo("/src/app", Options{ReportFile: reportFile})
+
+	errPull := errors.New("could not fetch origin")
+	errCheckout := errors.New("main has uncommitted changes")
+	var ranDelete bool
+
+	err := r.runSteps([]step{
+		{PhasePull, infallible(func() { r.errs = append(r.errs, errPull) })},
+		{PhaseCheckout, func() error { return errCheckout }},
+		{PhaseDelete, infallible(func() { ranDelete = true })},
+	})
+
+	if !errors.Is(err, errCheckout) || !errors.Is(err, errPull) {
+		t.Errorf("runSteps() error = %v, want both the abort and the earlier failure", err)
+	}
+
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Errorf("runSteps() error = %v, want it to include the partial failure", err)
+	}
+
+	if ranDelete {
+		t.Error("runSteps() ran the steps after the failed prerequisite")
+	}
+
+	data, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("report wasn't written: %v", err)
+	}
+
+	var rep report
+	if err := json.Unmarshal(data, &rep); err != nil {
+		t.Fatal(err)
+	}
+
+	if rep.Aborted != errCheckout.Error() {
+		t.Errorf("report aborted = %q, want %q", rep.Aborted, errCheckout.Error())
+	}
+
+	if len(rep.Failed) != 1 || rep.Failed[0] != PhaseCheckout {
+		t.Errorf("report failed = %q, want the checkout", rep.Failed)
+	}
+}
+
+func TestRunStepsSignatureFailure(t *testing.T) {
+	git := fakeGit{"log -1 --format=%h%x00%G?%x00%GS main": "3f78685\x00N\x00\n"}
+	r := newRepo("/src/app", Options{VerifySignature: true, Git: git})
+	r.defaultBranch = "main"
+
+	err := r.runSteps([]step{
+		{PhaseVerifySignature, r.verifySignature},
+	})
+
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseVerifySignature {
+		t.Errorf("runSteps() error = %#v, want it from the %s phase", err, PhaseVerifySignature)
+	}
+}
@@ -0,0 +1,143 @@
+package cleanup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mskelton/git-cleanup/pkg/streamer"
+)
+
+// poolWorktreePath returns where the worktree of a pool branch belongs, next
+// to the main worktree and named using the worktree prefix.
+func (r *repo) poolWorktreePath(branch string) string {
+	return filepath.Join(filepath.Dir(r.dir), r.opts.WorktreePrefix+branch)
+}
+
+// createPoolWorktrees adds a worktree for each pool branch that doesn't have
+// one, so the pool heals itself when a worktree has been removed.
+func (r *repo) createPoolWorktrees() {
+	var missing []string
+	for _, branch := range r.opts.PoolBranches {
+		if !slices.Contains(r.branches.WorktreePoolBranches, branch) {
+			missing = append(missing, branch)
+		}
+	}
+
+	for _, branch := range missing {
+		path := r.poolWorktreePath(branch)
+		relativePath := path
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			relativePath = strings.Replace(path, homeDir, "~", 1)
+		}
+
+		err := streamer.Run("Creating worktree: "+relativePath, func(outputChan chan<- string) error {
+			return r.createPoolWorktree(branch, path, outputChan)
+		})
+		if err != nil {
+			r.result.FailedOperations = append(r.result.FailedOperations, "create worktree "+relativePath)
+			r.errs = append(r.errs, fmt.Errorf("failed to create worktree %s: %w", relativePath, err))
+			continue
+		}
+
+		r.result.CreatedWorktrees = append(r.result.CreatedWorktrees, relativePath)
+
+		// A worktree that was only planned in a dry run has nothing to rebase
+		if !r.opts.DryRun {
+			r.branches.WorktreePoolBranches = append(r.branches.WorktreePoolBranches, branch)
+		}
+	}
+}
+
+func (r *repo) createPoolWorktree(branch, path string, outputChan chan<- string) error {
+	// Never add a worktree on top of something that is already there
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists but isn't a worktree of %s", path, branch)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if _, err := r.runner.Run("show-ref", "--verify", "--quiet", "refs/heads/"+branch); err == nil {
+		return r.runGit(outputChan, "worktree", "add", path, branch)
+	}
+
+	return r.runGit(outputChan, "worktree", "add", "-b", branch, path, r.worktreeBase)
+}
+
+// pruneEmptyWorktreeDirs removes the empty directories left next to the main
+// worktree by pool worktrees that no longer exist, which would otherwise stop
+// the worktree from being created again. Only the directories of the pruned
+// worktrees and of the pool branches are considered.
+func (r *repo) pruneEmptyWorktreeDirs(pruned []string) {
+	if !r.opts.PruneEmptyWorktreeDirs || r.opts.WorktreePrefix == "" {
+		return
+	}
+
+	dirs, err := r.emptyWorktreeDirs(pruned)
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("failed to find empty worktree directories: %w", err))
+		return
+	}
+
+	for _, dir := range dirs {
+		relativePath := dir
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			relativePath = strings.Replace(dir, homeDir, "~", 1)
+		}
+
+		if !r.opts.DryRun {
+			// Remove only ever removes a directory when it is empty
+			if err := os.Remove(dir); err != nil {
+				r.errs = append(r.errs, fmt.Errorf("failed to remove empty worktree directory: %w", err))
+				continue
+			}
+		}
+
+		r.result.RemovedDirs = append(r.result.RemovedDirs, relativePath)
+	}
+}
+
+// emptyWorktreeDirs returns the directories of the pruned worktrees and the
+// pool branches that are empty, named with the worktree prefix next to the
+// main worktree, and not registered as worktrees.
+func (r *repo) emptyWorktreeDirs(pruned []string) ([]string, error) {
+	worktrees, err := r.listWorktrees()
+	if err != nil {
+		return nil, err
+	}
+
+	// A dry run doesn't prune, so worktrees git would prune still count as gone
+	registered := []string{filepath.Clean(r.dir)}
+	for _, worktree := range worktrees {
+		if !worktree.Prunable {
+			registered = append(registered, filepath.Clean(worktree.Path))
+		}
+	}
+
+	candidates := slices.Clone(pruned)
+	for _, branch := range r.opts.PoolBranches {
+		candidates = append(candidates, r.poolWorktreePath(branch))
+	}
+
+	parent := filepath.Dir(r.dir)
+	var dirs []string
+	for _, path := range candidates {
+		path = filepath.Clean(path)
+		if filepath.Dir(path) != parent || !strings.HasPrefix(filepath.Base(path), r.opts.WorktreePrefix) {
+			continue
+		}
+
+		if slices.Contains(registered, path) || slices.Contains(dirs, path) {
+			continue
+		}
+
+		if contents, err := os.ReadDir(path); err == nil && len(contents) == 0 {
+			dirs = append(dirs, path)
+		}
+	}
+
+	return dirs, nil
+}
@@ -0,0 +1,94 @@
+package cleanup
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPruneEmptyWorktreeDirs(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "app")
+	mkdir := func(name string) string {
+		t.Helper()
+		path := filepath.Join(parent, name)
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	mkdir("app")
+	mustGit(t, dir, "init", "--quiet", "--initial-branch=main")
+	mustGit(t, dir, "commit", "--quiet", "--allow-empty", "-m", "base")
+
+	// Emptying a worktree's directory leaves git with a prunable worktree
+	removed := filepath.Join(parent, "web-removed")
+	mustGit(t, dir, "worktree", "add", "--quiet", "-b", "removed", removed)
+	if err := os.RemoveAll(removed); err != nil {
+		t.Fatal(err)
+	}
+	mkdir("web-removed")
+
+	pool := mkdir("web-pool")
+	kept := filepath.Join(parent, "web-kept")
+	mustGit(t, dir, "worktree", "add", "--quiet", "-b", "kept", kept)
+
+	// Neither was ever a worktree, so they are left alone
+	unrelated := mkdir("web-newapp")
+	other := mkdir("other-pool")
+
+	r := newRepo(dir, Options{
+		PruneEmptyWorktreeDirs: true,
+		WorktreePrefix:         "web-",
+		PoolBranches:           []string{"pool", "kept"},
+	})
+	r.pruneWorktrees()
+
+	if len(r.errs) > 0 {
+		t.Fatal(r.errs)
+	}
+
+	want := []string{removed, pool}
+	if !slices.Equal(r.result.RemovedDirs, want) {
+		t.Errorf("RemovedDirs = %q, want %q", r.result.RemovedDirs, want)
+	}
+
+	for _, path := range want {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+
+	for _, path := range []string{kept, unrelated, other} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed", path)
+		}
+	}
+}
+
+func TestRebaseWorktreePoolBranchUpToDate(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	mustGit(t, dir, "init", "--quiet", "--initial-branch=main")
+	mustGit(t, dir, "commit", "--quiet", "--allow-empty", "-m", "base")
+	mustGit(t, dir, "branch", "pool")
+
+	r := newRepo(dir, Options{})
+	outputChan := make(chan string, 10)
+
+	if err := r.rebaseWorktreePoolBranch(dir, "pool", "main", outputChan); !errors.Is(err, errUpToDate) {
+		t.Errorf("rebaseWorktreePoolBranch() error = %v, want %v", err, errUpToDate)
+	}
+}
@@ -0,0 +1,115 @@
+package cleanup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// confirmer asks the user to confirm actions one at a time, remembering when
+// they have chosen to accept all remaining actions.
+type confirmer struct {
+	scanner *bufio.Scanner
+	all     bool
+}
+
+func newConfirmer() *confirmer {
+	return &confirmer{scanner: bufio.NewScanner(os.Stdin)}
+}
+
+func (c *confirmer) confirm(prompt string) bool {
+	if c.all {
+		return true
+	}
+
+	for {
+		fmt.Printf("%s [y/n/a] ", prompt)
+		if !c.scanner.Scan() {
+			return false
+		}
+
+		switch strings.ToLower(strings.TrimSpace(c.scanner.Text())) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		case "a", "all":
+			c.all = true
+			return true
+		}
+	}
+}
+
+// confirmBranches prompts for each worktree reset and branch deletion,
+// returning the branches the user approved and those they declined.
+func confirmBranches(worktreeBranches, deletedBranches []string) (approvedWorktrees, approvedDeletes, declined []string) {
+	c := newConfirmer()
+
+	for _, branch := range worktreeBranches {
+		if c.confirm(fmt.Sprintf("Reset worktree for %s?", branch)) {
+			approvedWorktrees = append(approvedWorktrees, branch)
+		} else {
+			declined = append(declined, branch)
+		}
+	}
+
+	for _, branch := range deletedBranches {
+		// A branch can't be deleted while its worktree still has it checked out
+		if slices.Contains(declined, branch) {
+			continue
+		}
+
+		if c.confirm(fmt.Sprintf("Delete branch %s?", branch)) {
+			approvedDeletes = append(approvedDeletes, branch)
+		} else {
+			declined = append(declined, branch)
+		}
+	}
+
+	return approvedWorktrees, approvedDeletes, declined
+}
+
+// confirmOldBranches asks before deleting each branch older than the max
+// branch age, skipping them all when there is no terminal to ask in. Only the
+// modes deleting branches ask, as the others would never delete them.
+func (r *repo) confirmOldBranches() {
+	if len(r.branches.OldBranches) == 0 || !r.opts.runsPhase(PhaseDelete) {
+		return
+	}
+
+	prompt := term.IsTerminal(int(os.Stdin.Fd()))
+	c := newConfirmer()
+
+	for _, branch := range r.branches.OldBranches {
+		// Git won't delete the checked out branch
+		if branch.Name == r.currentBranch {
+			warn("Skipping current branch: %s (check out another branch to delete it)", r.currentBranch)
+			r.result.SkippedBranches = append(r.result.SkippedBranches, branch.Name)
+			continue
+		}
+
+		days := int(branch.Age.Hours() / 24)
+		age := fmt.Sprintf("%d %s", days, plural(days, "day", "days"))
+
+		if !prompt {
+			warn("Skipping branch last updated %s ago: %s (use --force to delete)", age, branch.Name)
+			r.result.SkippedBranches = append(r.result.SkippedBranches, branch.Name)
+			continue
+		}
+
+		if !c.confirm(fmt.Sprintf("Delete branch %s last updated %s ago?", branch.Name, age)) {
+			r.result.SkippedBranches = append(r.result.SkippedBranches, branch.Name)
+			continue
+		}
+
+		if branch.InWorktree {
+			r.branches.WorktreeBranches = append(r.branches.WorktreeBranches, branch.Name)
+		}
+
+		r.branches.DeletedBranches = append(r.branches.DeletedBranches, branch.Name)
+	}
+}
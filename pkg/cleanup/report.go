@@ -0,0 +1,82 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// report is the record of a run appended to the report file.
+type report struct {
+	Time    time.Time       `json:"time"`
+	Repo    string          `json:"repo"`
+	DryRun  bool            `json:"dryRun,omitempty"`
+	Deleted []deletedBranch `json:"deleted,omitempty"`
+	Tags    []string        `json:"deletedTags,omitempty"`
+	Reset   []string        `json:"reset,omitempty"`
+	Created []string        `json:"created,omitempty"`
+	Removed []string        `json:"removedDirs,omitempty"`
+	Rebased []string        `json:"rebased,omitempty"`
+	Skipped []string        `json:"skipped,omitempty"`
+	Failed  []string        `json:"failed,omitempty"`
+	Errors  []string        `json:"errors,omitempty"`
+	// Aborted is the error that stopped the cleanup before it finished
+	Aborted string `json:"aborted,omitempty"`
+	// Signature is the verified signature of the default branch
+	Signature string `json:"signature,omitempty"`
+}
+
+type deletedBranch struct {
+	Branch string `json:"branch"`
+	SHA    string `json:"sha"`
+}
+
+// writeReport appends a JSON line describing the run to the report file,
+// creating it and its parent directories if needed.
+func (r *repo) writeReport(path string, aborted error) error {
+	rep := report{
+		Time:    time.Now(),
+		Repo:    r.dir,
+		DryRun:  r.opts.DryRun,
+		Tags:    r.result.DeletedTags,
+		Reset:   r.result.ResetWorktrees,
+		Created: r.result.CreatedWorktrees,
+		Removed: r.result.RemovedDirs,
+		Rebased: r.result.RebasedBranches,
+		Skipped: r.result.SkippedBranches,
+		Failed:  r.result.FailedOperations,
+
+		Signature: r.result.Signature,
+	}
+
+	for _, branch := range r.result.DeletedBranches {
+		rep.Deleted = append(rep.Deleted, deletedBranch{branch, r.branches.GoneSHAs[branch]})
+	}
+
+	for _, err := range r.errs {
+		rep.Errors = append(rep.Errors, err.Error())
+	}
+
+	if aborted != nil {
+		rep.Aborted = aborted.Error()
+	}
+
+	data, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,56 @@
+package cleanup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// signatureStatuses describes the signature status letters of git log's %G?
+// placeholder.
+var signatureStatuses = map[string]string{
+	"G": "good signature",
+	"U": "good signature with unknown validity",
+	"X": "good signature that has expired",
+	"Y": "good signature made by an expired key",
+	"R": "good signature made by a revoked key",
+	"E": "signature that can't be checked",
+	"B": "bad signature",
+	"N": "no signature",
+}
+
+// verifySignature checks that the commit the default branch points to has a
+// valid signature, refusing to clean up on top of one that doesn't.
+func (r *repo) verifySignature() error {
+	if !r.opts.VerifySignature {
+		return nil
+	}
+
+	output, err := r.runner.Run("log", "-1", "--format=%h%x00%G?%x00%GS", r.defaultBranch)
+	if err != nil {
+		return fmt.Errorf("failed to get the signature of %s: %w", r.defaultBranch, err)
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(string(output)), "\x00", 3)
+	if len(fields) != 3 {
+		return fmt.Errorf("unexpected output from git log: %q", output)
+	}
+
+	sha, status, signer := fields[0], fields[1], fields[2]
+	description, ok := signatureStatuses[status]
+	if !ok {
+		description = "unknown signature status " + status
+	}
+
+	// git decides which signatures are valid, e.g. taking gpg.minTrustLevel
+	// into account
+	if _, err := r.runner.Run("verify-commit", r.defaultBranch); err != nil {
+		return fmt.Errorf("%s is at %s which doesn't have a valid signature (%s), refusing to clean up", r.defaultBranch, sha, description)
+	}
+
+	r.result.Signature = fmt.Sprintf("%s at %s has a %s", r.defaultBranch, sha, description)
+	if signer != "" {
+		r.result.Signature += " from " + signer
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package cleanup
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// isSquashMerged reports whether the changes on the branch have been squash
+// merged into the default branch. Squashing the branch gives a commit with the
+// same patch ID as the diff from its merge base, so the branch is squash
+// merged when a commit on the default branch since then has that patch ID.
+func (r *repo) isSquashMerged(branch string) (bool, error) {
+	output, err := r.runner.Run("merge-base", r.defaultBranch, branch)
+	if err != nil {
+		return false, fmt.Errorf("failed to find the merge base of %s: %w", branch, err)
+	}
+	mergeBase := strings.TrimSpace(string(output))
+
+	// Without any changes there is no squash merge to find, and the empty
+	// diff has no patch ID to compare
+	output, err = r.runner.Run("rev-parse", mergeBase+"^{tree}", branch+"^{tree}")
+	if err != nil {
+		return false, fmt.Errorf("failed to get the tree of %s: %w", branch, err)
+	}
+	if trees := strings.Fields(string(output)); len(trees) == 2 && trees[0] == trees[1] {
+		return false, nil
+	}
+
+	// Comparing patch IDs only reads the repository, unlike squashing the
+	// branch with commit-tree, which writes an object and needs an identity
+	diff, err := r.runner.Run("diff", "--no-color", "--no-ext-diff", mergeBase, branch)
+	if err != nil {
+		return false, fmt.Errorf("failed to diff %s: %w", branch, err)
+	}
+
+	squashed, err := r.patchIDs(diff)
+	if err != nil || len(squashed) == 0 {
+		return false, err
+	}
+
+	log, err := r.runner.Run("log", "--no-merges", "--no-color", "--no-ext-diff", "-p", mergeBase+".."+r.defaultBranch)
+	if err != nil {
+		return false, fmt.Errorf("failed to compare %s with %s: %w", branch, r.defaultBranch, err)
+	}
+
+	merged, err := r.patchIDs(log)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.Contains(merged, squashed[0]), nil
+}
+
+// patchIDs returns the stable patch IDs of the patches in the output of git
+// diff or git log -p.
+func (r *repo) patchIDs(patches []byte) ([]string, error) {
+	if len(patches) == 0 {
+		return nil, nil
+	}
+
+	args := []string{"patch-id", "--stable"}
+	cmd := r.git(args...)
+	cmd.Stdin = bytes.NewReader(patches)
+
+	start := time.Now()
+	output, err := cmd.Output()
+	logGit(args, start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute patch IDs: %w", err)
+	}
+
+	var ids []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if id, _, ok := strings.Cut(line, " "); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,101 @@
+package cleanup
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsSquashMerged(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	// Without an identity, writing a commit would fail
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustGit(t, dir, "init", "--quiet", "--initial-branch=main")
+	mustGit(t, dir, "config", "user.useConfigOnly", "true")
+	write("base.txt", "base\n")
+	mustGit(t, dir, "add", ".")
+	mustGit(t, dir, "commit", "--quiet", "-m", "base")
+
+	// squashed is merged as a single commit, with main moving on after it
+	mustGit(t, dir, "switch", "--quiet", "-c", "squashed")
+	write("a.txt", "a\n")
+	mustGit(t, dir, "add", ".")
+	mustGit(t, dir, "commit", "--quiet", "-m", "a")
+	write("b.txt", "b\n")
+	mustGit(t, dir, "add", ".")
+	mustGit(t, dir, "commit", "--quiet", "-m", "b")
+
+	mustGit(t, dir, "switch", "--quiet", "main")
+	mustGit(t, dir, "merge", "--quiet", "--squash", "squashed")
+	mustGit(t, dir, "commit", "--quiet", "-m", "squashed")
+	write("c.txt", "c\n")
+	mustGit(t, dir, "add", ".")
+	mustGit(t, dir, "commit", "--quiet", "-m", "c")
+
+	// partial only had one of its commits merged
+	mustGit(t, dir, "switch", "--quiet", "-c", "partial", "main~2")
+	write("d.txt", "d\n")
+	mustGit(t, dir, "add", ".")
+	mustGit(t, dir, "commit", "--quiet", "-m", "d")
+	write("e.txt", "e\n")
+	mustGit(t, dir, "add", ".")
+	mustGit(t, dir, "commit", "--quiet", "-m", "e")
+	mustGit(t, dir, "switch", "--quiet", "main")
+	mustGit(t, dir, "cherry-pick", "partial~1")
+
+	mustGit(t, dir, "branch", "empty", "main")
+
+	objects := func() string {
+		t.Helper()
+		output, err := exec.Command("git", "-C", dir, "count-objects").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(output)
+	}
+	before := objects()
+
+	tests := []struct {
+		branch string
+		want   bool
+	}{
+		{branch: "squashed", want: true},
+		{branch: "partial", want: false},
+		{branch: "empty", want: false},
+	}
+
+	r := newRepo(dir, Options{})
+	r.defaultBranch = "main"
+
+	for _, tt := range tests {
+		t.Run(tt.branch, func(t *testing.T) {
+			got, err := r.isSquashMerged(tt.branch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("isSquashMerged(%q) = %v, want %v", tt.branch, got, tt.want)
+			}
+		})
+	}
+
+	if after := objects(); after != before {
+		t.Errorf("count-objects = %q, want %q as checking must not write objects", after, before)
+	}
+}
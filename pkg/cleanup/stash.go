@@ -0,0 +1,167 @@
+package cleanup
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/mskelton/git-cleanup/pkg/streamer"
+)
+
+// stash is an entry in the repo's stash list.
+type stash struct {
+	Ref     string
+	Branch  string
+	Message string
+}
+
+// stashMessage returns the template for the message of stashes made before
+// rebasing the worktree pool.
+func (r *repo) stashMessage() string {
+	if r.opts.StashMessage == "" {
+		return DefaultStashMessage
+	}
+
+	return r.opts.StashMessage
+}
+
+// pushStash stashes the changes in the worktree, returning the stash commit.
+// Every worktree shares the same stash list, so stashes are pushed and popped
+// one at a time.
+func (r *repo) pushStash(worktreePath, message string, outputChan chan<- string) (string, error) {
+	r.stashMu.Lock()
+	defer r.stashMu.Unlock()
+
+	if err := r.runGit(outputChan, "-C", worktreePath, "stash", "push", "-m", message); err != nil || r.opts.DryRun {
+		return "", err
+	}
+
+	output, err := r.runner.Run("rev-parse", "refs/stash")
+	if err != nil {
+		return "", fmt.Errorf("failed to find the stash: %w", err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// popStashCommit pops the stash made by pushStash, finding where it is in the
+// stash list as worktrees rebased alongside it may have pushed their own.
+func (r *repo) popStashCommit(worktreePath, commit string, outputChan chan<- string) error {
+	r.stashMu.Lock()
+	defer r.stashMu.Unlock()
+
+	// Nothing was stashed in a dry run
+	ref := "stash@{0}"
+	if !r.opts.DryRun {
+		output, err := r.runner.Run("stash", "list", "--format=%gd%x00%H")
+		if err != nil {
+			return fmt.Errorf("failed to list stashes: %w", err)
+		}
+
+		ref = ""
+		for _, line := range strings.Split(string(output), "\n") {
+			if stashRef, hash, ok := strings.Cut(line, "\x00"); ok && hash == commit {
+				ref = stashRef
+				break
+			}
+		}
+
+		if ref == "" {
+			return fmt.Errorf("stash %s is no longer in the stash list", commit)
+		}
+	}
+
+	return r.popStash(worktreePath, ref, outputChan)
+}
+
+// orphanedStashes returns the stashes made before rebasing the worktree pool
+// that were never restored, which happens when a cleanup is interrupted or the
+// stashed changes conflict.
+func (r *repo) orphanedStashes() ([]stash, error) {
+	// Without any text before the placeholders, there is no telling our
+	// stashes apart from any others
+	prefix, _, _ := strings.Cut(r.stashMessage(), "{")
+	if prefix == "" {
+		return nil, nil
+	}
+
+	output, err := r.runner.Run("stash", "list", "--format=%gd%x00%gs")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stashes: %w", err)
+	}
+
+	var stashes []stash
+	for _, line := range strings.Split(string(output), "\n") {
+		ref, subject, ok := strings.Cut(line, "\x00")
+		if !ok {
+			continue
+		}
+
+		// Stashes pushed with a message are described as "On <branch>: <message>"
+		branch, message, ok := strings.Cut(strings.TrimPrefix(subject, "On "), ": ")
+		if ok && strings.HasPrefix(message, prefix) {
+			stashes = append(stashes, stash{Ref: ref, Branch: branch, Message: message})
+		}
+	}
+
+	return stashes, nil
+}
+
+// checkOrphanedStashes warns about stashes left behind by earlier cleanups,
+// or restores them in their worktrees when recovering stashes.
+func (r *repo) checkOrphanedStashes() {
+	stashes, err := r.orphanedStashes()
+	if err != nil {
+		slog.Debug("failed to check for orphaned stashes", "error", err)
+		return
+	}
+
+	if len(stashes) == 0 {
+		return
+	}
+
+	if !r.opts.RecoverStashes {
+		for _, s := range stashes {
+			warn("Found a stash left by an earlier cleanup: %s (%s), use --recover-stashes to restore it", s.Ref, s.Message)
+		}
+
+		return
+	}
+
+	err = streamer.Run("Recovering stashes", func(outputChan chan<- string) error {
+		var errs []error
+
+		// Popping a stash renumbers the ones after it, so start from the end
+		for i := len(stashes) - 1; i >= 0; i-- {
+			if err := r.recoverStash(stashes[i], outputChan); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", stashes[i].Ref, err))
+			}
+		}
+
+		return errors.Join(errs...)
+	})
+	if err != nil {
+		r.result.FailedOperations = append(r.result.FailedOperations, "recover stashes")
+		r.errs = append(r.errs, fmt.Errorf("failed to recover stashes: %w", err))
+	}
+}
+
+// recoverStash pops the stash in the worktree of the branch it was made on,
+// as long as the worktree has no changes of its own.
+func (r *repo) recoverStash(s stash, outputChan chan<- string) error {
+	worktreePath, err := r.getWorktreePath(s.Branch)
+	if err != nil {
+		return err
+	}
+
+	dirty, err := r.hasUncommittedChanges(worktreePath)
+	if err != nil {
+		return err
+	} else if dirty {
+		return fmt.Errorf("%s has uncommitted changes", worktreePath)
+	}
+
+	outputChan <- fmt.Sprintf("Restoring %s in %s", s.Ref, worktreePath)
+	return r.popStash(worktreePath, s.Ref, outputChan)
+}
@@ -0,0 +1,84 @@
+package cleanup
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPopStashConflict(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "test")
+	}
+
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "test@example.com")
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file.txt")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustGit(t, dir, "init", "--quiet")
+	write("base\n")
+	mustGit(t, dir, "add", "file.txt")
+	mustGit(t, dir, "commit", "--quiet", "-m", "base")
+
+	r := newRepo(dir, Options{})
+	outputChan := make(chan string, 100)
+
+	// Stash a change, then commit a conflicting one as a rebase would
+	write("stashed\n")
+	commit, err := r.pushStash(dir, "git-cleanup test", outputChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("rebased\n")
+	mustGit(t, dir, "commit", "--quiet", "--all", "-m", "rebased")
+
+	err = r.popStashCommit(dir, commit, outputChan)
+	if !errors.Is(err, errStashConflict) {
+		t.Fatalf("popStashCommit() error = %v, want %v", err, errStashConflict)
+	}
+
+	if !strings.Contains(err.Error(), "stash@{0}") {
+		t.Errorf("popStashCommit() error = %v, want it to name the preserved stash", err)
+	}
+
+	// The stash is kept for the changes to be restored by hand
+	stashes, err := exec.Command("git", "-C", dir, "stash", "list", "--format=%H").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(string(stashes)) != commit {
+		t.Errorf("stash list = %q, want the stash %s to be kept", stashes, commit)
+	}
+
+	// The half-applied changes are rolled back
+	status, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(status) > 0 {
+		t.Errorf("worktree status = %q, want the worktree to be clean", status)
+	}
+
+	if content, _ := os.ReadFile(file); string(content) != "rebased\n" {
+		t.Errorf("file content = %q, want the rebased content", content)
+	}
+}
@@ -0,0 +1,49 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/fatih/color"
+	"github.com/mskelton/git-cleanup/pkg/streamer"
+)
+
+// cleanupSubmodules prunes and deletes gone branches in each of the
+// initialized submodules of the repo, including nested ones.
+func cleanupSubmodules(ctx context.Context, dir string, opts Options) ([]Summary, error) {
+	paths, err := gitLines(opts.runnerIn(dir), "submodule", "foreach", "--quiet", "--recursive", `echo "$toplevel/$sm_path"`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list submodules: %w", err)
+	}
+
+	// The default branch of the superproject is unlikely to be the default
+	// branch of its submodules
+	opts.DefaultBranch = ""
+
+	var summaries []Summary
+	var errs []error
+	for _, path := range paths {
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			name = path
+		}
+
+		if !streamer.Quiet {
+			fmt.Println()
+			color.New(color.Bold).Println("Submodule " + name)
+		}
+
+		summary, err := cleanupRepo(ctx, path, opts, (*repo).cleanupBranches)
+		if summary != nil {
+			summaries = append(summaries, *summary)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("submodule %s: %w", name, err))
+		}
+	}
+
+	return summaries, errors.Join(errs...)
+}
@@ -0,0 +1,92 @@
+package cleanup
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Summary records what a cleanup did to a repository so it can be reported at
+// the end.
+type Summary struct {
+	Dir              string
+	DeletedBranches  []string
+	DeletedTags      []string
+	ResetWorktrees   []string
+	CreatedWorktrees []string
+	// RemovedDirs are the empty directories of pool worktrees that no longer
+	// exist
+	RemovedDirs      []string
+	RebasedBranches  []string
+	SkippedBranches  []string
+	FailedOperations []string
+	// Signature describes the verified signature of the default branch
+	Signature string
+	// RebasePlans are the rebases of the worktree pool that would be done in a
+	// dry run
+	RebasePlans []RebasePlan
+	// DryRun is whether the changes were only shown rather than made
+	DryRun bool
+}
+
+// RebasePlan describes how a worktree pool branch would be rebased.
+type RebasePlan struct {
+	Branch string
+	Base   string
+	// Commits are the commits that would be replayed, one line each
+	Commits []string
+	// Dirty is whether the worktree has changes that would be stashed
+	Dirty bool
+}
+
+func (s *Summary) print() {
+	label := func(done, dryRun string) string {
+		if s.DryRun {
+			return dryRun
+		}
+
+		return done
+	}
+
+	sections := []struct {
+		label string
+		items []string
+		color *color.Color
+	}{
+		{label("Deleted", "Would delete"), s.DeletedBranches, color.New(color.FgGreen)},
+		{label("Deleted tags", "Would delete tags"), s.DeletedTags, color.New(color.FgGreen)},
+		{label("Reset", "Would reset"), s.ResetWorktrees, color.New(color.FgGreen)},
+		{label("Created", "Would create"), s.CreatedWorktrees, color.New(color.FgGreen)},
+		{label("Removed", "Would remove"), s.RemovedDirs, color.New(color.FgGreen)},
+		{label("Rebased", "Would rebase"), s.RebasedBranches, color.New(color.FgGreen)},
+		{"Skipped", s.SkippedBranches, color.New(color.FgYellow)},
+		{"Failed", s.FailedOperations, color.New(color.FgRed)},
+	}
+
+	for _, section := range sections {
+		if len(section.items) == 0 {
+			continue
+		}
+
+		section.color.Printf("%s (%d): ", section.label, len(section.items))
+		fmt.Println(strings.Join(section.items, ", "))
+	}
+
+	if s.Signature != "" {
+		color.New(color.FgGreen).Print("Verified: ")
+		fmt.Println(s.Signature)
+	}
+
+	for _, plan := range s.RebasePlans {
+		stash := ""
+		if plan.Dirty {
+			stash = ", stashing uncommitted changes"
+		}
+
+		color.Cyan("Would rebase %s onto %s (%d %s%s):", plan.Branch, plan.Base, len(plan.Commits), plural(len(plan.Commits), "commit", "commits"), stash)
+		for _, commit := range plan.Commits {
+			fmt.Println("  " + commit)
+		}
+	}
+}
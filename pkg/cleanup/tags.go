@@ -0,0 +1,179 @@
+package cleanup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mskelton/git-cleanup/pkg/streamer"
+)
+
+// remoteTagsName is the file in the git directory recording the tags seen on
+// each remote, so tags deleted from a remote can be told apart from tags that
+// were only ever created locally.
+const remoteTagsName = "cleanup-remote-tags"
+
+// pruneTags deletes local tags that were on the remote the last time it was
+// checked, but have since been deleted from it.
+func (r *repo) pruneTags() {
+	if !r.opts.PruneTags || r.opts.NoFetch {
+		return
+	}
+
+	err := streamer.Run("Pruning tags", func(outputChan chan<- string) error {
+		var err error
+		r.result.DeletedTags, err = r.deleteGoneTags(outputChan)
+		return err
+	})
+	if err != nil {
+		r.result.FailedOperations = append(r.result.FailedOperations, "prune tags")
+		r.errs = append(r.errs, fmt.Errorf("failed to prune tags: %w", err))
+	}
+}
+
+func (r *repo) deleteGoneTags(outputChan chan<- string) ([]string, error) {
+	remoteTags, err := r.remoteTags()
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := r.gitPath(remoteTagsName)
+	if err != nil {
+		return nil, err
+	}
+
+	seen, err := readRemoteTags(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	localTags, err := r.runner.Run("for-each-ref", "--format=%(refname:strip=2)", "refs/tags")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+
+	// Tags the remote has never had were created locally, so are kept
+	var gone []string
+	for _, tag := range strings.Fields(string(localTags)) {
+		if slices.Contains(seen[r.opts.Remote], tag) && !slices.Contains(remoteTags, tag) {
+			gone = append(gone, tag)
+		}
+	}
+
+	if len(gone) > 0 {
+		output, err := r.combinedOutput(r.git(append([]string{"tag", "-d"}, gone...)...))
+		if err != nil {
+			return nil, errors.New(strings.TrimSpace(string(output)))
+		}
+
+		for _, tag := range gone {
+			outputChan <- fmt.Sprintf("Deleted tag %s", tag)
+		}
+	}
+
+	if r.opts.DryRun {
+		return gone, nil
+	}
+
+	seen[r.opts.Remote] = remoteTags
+	if err := writeRemoteTags(path, seen); err != nil {
+		return gone, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	return gone, nil
+}
+
+// remoteTags returns the tags that currently exist on the remote.
+func (r *repo) remoteTags() ([]string, error) {
+	if err := r.checkAllowedHosts(r.opts.Remote); err != nil {
+		return nil, err
+	}
+
+	// A stalled remote would otherwise hang the cleanup, so honor the timeout
+	ctx, cancel := r.timeoutContext()
+	defer cancel()
+
+	args := []string{"ls-remote", "--tags", "--refs", r.opts.Remote}
+	start := time.Now()
+	output, err := r.gitContext(ctx, args...).Output()
+	logGit(args, start, err)
+
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("failed to list tags on %s: timed out after %s", r.opts.Remote, r.opts.Timeout)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags on %s: %w", r.opts.Remote, err)
+	}
+
+	var tags []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if _, ref, ok := strings.Cut(line, "\t"); ok {
+			tags = append(tags, strings.TrimPrefix(ref, "refs/tags/"))
+		}
+	}
+
+	return tags, nil
+}
+
+// gitPath returns the path of a file in the repo's git directory.
+func (r *repo) gitPath(name string) (string, error) {
+	r.gitDirOnce.Do(func() {
+		output, err := r.runner.Run("rev-parse", "--git-common-dir")
+		if err != nil {
+			r.gitDirErr = fmt.Errorf("failed to get git directory: %w", err)
+			return
+		}
+
+		r.gitDir = strings.TrimSpace(string(output))
+		if !filepath.IsAbs(r.gitDir) {
+			r.gitDir = filepath.Join(r.dir, r.gitDir)
+		}
+	})
+
+	if r.gitDirErr != nil {
+		return "", r.gitDirErr
+	}
+
+	return filepath.Join(r.gitDir, name), nil
+}
+
+// readRemoteTags reads the tags seen on each remote, one tab separated remote
+// and tag per line.
+func readRemoteTags(path string) (map[string][]string, error) {
+	tags := map[string][]string{}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return tags, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if remote, tag, ok := strings.Cut(scanner.Text(), "\t"); ok {
+			tags[remote] = append(tags[remote], tag)
+		}
+	}
+
+	return tags, scanner.Err()
+}
+
+func writeRemoteTags(path string, tags map[string][]string) error {
+	var b strings.Builder
+	for remote, names := range tags {
+		for _, tag := range names {
+			fmt.Fprintf(&b, "%s\t%s\n", remote, tag)
+		}
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
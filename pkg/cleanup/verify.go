@@ -0,0 +1,37 @@
+package cleanup
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// verify checks that every branch meant to be deleted is gone, reporting any
+// that remain without the cleanup having said why.
+func (r *repo) verify() {
+	if !r.opts.Verify || r.opts.DryRun || len(r.branches.DeletedBranches) == 0 {
+		return
+	}
+
+	output, err := r.runner.Run("for-each-ref", "--format=%(refname:short)", "refs/heads")
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("failed to verify branches were deleted: %w", err))
+		return
+	}
+
+	branches := strings.Fields(string(output))
+	for _, branch := range r.branches.DeletedBranches {
+		if !slices.Contains(branches, branch) || slices.Contains(r.result.SkippedBranches, branch) || slices.Contains(r.result.FailedOperations, "delete "+branch) {
+			continue
+		}
+
+		color.Red("Branch still exists after being deleted: %s", branch)
+		r.result.DeletedBranches = slices.DeleteFunc(r.result.DeletedBranches, func(b string) bool {
+			return b == branch
+		})
+		r.result.FailedOperations = append(r.result.FailedOperations, "verify "+branch)
+		r.errs = append(r.errs, fmt.Errorf("%s still exists after being deleted", branch))
+	}
+}
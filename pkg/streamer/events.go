@@ -0,0 +1,62 @@
+package streamer
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Events receives a newline-delimited JSON event for each step of every
+// operation, letting other tools follow progress without parsing the terminal
+// output. Nothing is written when it is nil.
+var Events io.Writer
+
+var eventsMu sync.Mutex
+
+// Event describes a step in the lifecycle of an operation.
+type Event struct {
+	// Type is one of "start", "output" or "complete"
+	Type  string    `json:"type"`
+	Title string    `json:"title"`
+	Time  time.Time `json:"time"`
+	// Line is the line of output for "output" events
+	Line string `json:"line,omitempty"`
+	// Status is "success" or "failure" for "complete" events
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func emit(event Event) {
+	if Events == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+
+	// Events are best effort, a reader going away shouldn't stop the cleanup
+	_, _ = Events.Write(append(data, '\n'))
+}
+
+func emitStart(title string) {
+	emit(Event{Type: "start", Title: title})
+}
+
+func emitOutput(title, line string) {
+	emit(Event{Type: "output", Title: title, Line: line})
+}
+
+func emitComplete(title string, err error) {
+	if err != nil {
+		emit(Event{Type: "complete", Title: title, Status: "failure", Error: err.Error()})
+	} else {
+		emit(Event{Type: "complete", Title: title, Status: "success"})
+	}
+}
@@ -0,0 +1,31 @@
+package streamer
+
+import "regexp"
+
+// DefaultOutputFilter matches the progress lines git writes while fetching,
+// pulling and checking out, which would otherwise push everything else out of
+// the displayed output.
+var DefaultOutputFilter = []*regexp.Regexp{
+	regexp.MustCompile(`^remote: (Enumerating|Counting|Compressing|Total|Finding sources)\b`),
+	regexp.MustCompile(`^remote:\s*$`),
+	regexp.MustCompile(`^(Enumerating|Counting|Compressing|Receiving|Writing|Unpacking) objects:`),
+	regexp.MustCompile(`^Resolving deltas:`),
+	regexp.MustCompile(`^Updating files:`),
+	regexp.MustCompile(`^Checking connectivity`),
+}
+
+// OutputFilter hides lines of command output matching any of these patterns,
+// both from the preview shown while a command runs and from verbose output.
+// Hidden lines are still included in the errors of failed commands.
+var OutputFilter = DefaultOutputFilter
+
+// filtered reports whether the line is hidden by the OutputFilter.
+func filtered(line string) bool {
+	for _, pattern := range OutputFilter {
+		if pattern.MatchString(line) {
+			return true
+		}
+	}
+
+	return false
+}
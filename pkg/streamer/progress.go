@@ -0,0 +1,151 @@
+package streamer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+	"golang.org/x/term"
+)
+
+// barWidth is the number of characters the progress bar is drawn with.
+const barWidth = 20
+
+// ProgressMode selects how operations made up of many steps are displayed. It
+// implements pflag.Value.
+type ProgressMode string
+
+const (
+	// ProgressSpinner shows a spinner for each step
+	ProgressSpinner ProgressMode = "spinner"
+	// ProgressBar shows a single progress bar for all the steps
+	ProgressBar ProgressMode = "bar"
+)
+
+// ProgressModes are the names accepted by ProgressMode.Set.
+var ProgressModes = []string{string(ProgressSpinner), string(ProgressBar)}
+
+// Progress is how operations made up of many steps are displayed.
+var Progress = ProgressSpinner
+
+func (p *ProgressMode) Set(value string) error {
+	switch ProgressMode(value) {
+	case ProgressSpinner, ProgressBar:
+		*p = ProgressMode(value)
+		return nil
+	}
+
+	return fmt.Errorf("unknown progress mode %q, use one of %s", value, strings.Join(ProgressModes, ", "))
+}
+
+func (p *ProgressMode) String() string {
+	return string(*p)
+}
+
+func (p *ProgressMode) Type() string {
+	return "mode"
+}
+
+// progressBar is a single line showing how many steps have finished.
+type progressBar struct {
+	title string
+	done  int
+	total int
+	// terminal is whether the bar can be redrawn in place
+	terminal bool
+}
+
+// bar is the progress bar being displayed, guarded by activeMu. While it is
+// displayed, operations run by Run are only displayed if they fail.
+var bar *progressBar
+
+// BeginProgress starts displaying a progress bar for the given number of
+// steps, when the progress bar mode is selected. Each step is counted with
+// Advance, until EndProgress is called.
+func BeginProgress(title string, total int) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	if Progress != ProgressBar || Quiet || stopped {
+		return
+	}
+
+	bar = &progressBar{title: title, total: total, terminal: term.IsTerminal(int(os.Stdout.Fd()))}
+	if !bar.terminal {
+		fmt.Println("\u2022 " + title)
+	}
+
+	bar.draw()
+}
+
+// Advance counts a finished step of the progress bar, if one is displayed.
+func Advance() {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	if bar != nil {
+		bar.done = min(bar.done+1, bar.total)
+		bar.draw()
+	}
+}
+
+// EndProgress stops displaying the progress bar, marking it as failed when
+// any of its steps failed.
+func EndProgress(err error) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	if bar == nil {
+		return
+	}
+
+	bar.clear()
+	line := bar.String()
+	if err != nil {
+		fmt.Println(color.RedString("\u2716 " + line))
+	} else {
+		fmt.Println("\u2714 " + line)
+	}
+
+	bar = nil
+}
+
+// Above prints above the progress bar, if one is displayed, so the printed
+// lines aren't drawn over.
+func Above(print func()) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	if bar == nil {
+		print()
+		return
+	}
+
+	bar.clear()
+	print()
+	bar.draw()
+}
+
+func (b *progressBar) String() string {
+	filled := barWidth
+	if b.total > 0 {
+		filled = barWidth * b.done / b.total
+	}
+
+	return fmt.Sprintf("%s [%s%s] %d/%d", b.title, strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled), b.done, b.total)
+}
+
+// draw redraws the bar in place. Redirected output is only ever appended to,
+// so only the finished bar is printed there.
+func (b *progressBar) draw() {
+	if b.terminal {
+		fmt.Print("\r\033[K  " + b.String())
+	}
+}
+
+func (b *progressBar) clear() {
+	if b.terminal {
+		fmt.Print("\r\033[K")
+	}
+}
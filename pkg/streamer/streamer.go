@@ -2,87 +2,318 @@ package streamer
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/briandowns/spinner"
 	"github.com/fatih/color"
+	"golang.org/x/term"
 )
 
 const (
-	charSet         = 14
-	maxDisplayLines = 2
+	// DefaultOutputLines is the number of output lines shown below the spinner
+	// by default
+	DefaultOutputLines = 2
+	// DefaultSpinnerInterval is how often the spinner is redrawn by default
+	DefaultSpinnerInterval = 100 * time.Millisecond
+	// statusInterval is how often a static status line is printed for an
+	// operation that is still running
+	statusInterval = 30 * time.Second
+	// defaultWidth is assumed when the terminal width can't be determined
+	defaultWidth = 80
 )
 
+var (
+	// Verbose prints every line of command output permanently, along with the
+	// command being run, instead of only showing a live preview.
+	Verbose bool
+
+	// Quiet hides the spinner and successful operations, only printing the
+	// operations that fail.
+	Quiet bool
+
+	// OutputLines is the number of the latest output lines shown while an
+	// operation runs. When zero, only the spinner is shown.
+	OutputLines = DefaultOutputLines
+
+	// SpinnerStyle is the character set used to draw the spinner
+	SpinnerStyle = DefaultSpinnerStyle
+
+	// SpinnerInterval is how often the spinner is redrawn
+	SpinnerInterval = DefaultSpinnerInterval
+
+	// NoSpinner prints a static line for each operation instead of animating a
+	// spinner, for logs that don't handle carriage returns
+	NoSpinner bool
+
+	// ErrorOutput is where the operations that fail are printed
+	ErrorOutput io.Writer = os.Stderr
+)
+
+// active is the streamer displaying the running operation, guarded by
+// activeMu so that it can be stopped from another goroutine. Once stopped,
+// nothing more is displayed.
+var (
+	active   *OutputStreamer
+	stopped  bool
+	activeMu sync.Mutex
+)
+
+// Stop stops displaying the running operation, marking it as interrupted and
+// restoring the cursor. Any operations that run afterwards aren't displayed,
+// as it's called when exiting early, such as when interrupted.
+func Stop() {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	stopped = true
+	if bar != nil {
+		bar.clear()
+		fmt.Println(color.RedString("\u2716 " + bar.String() + " (interrupted)"))
+		bar = nil
+	}
+
+	if active == nil {
+		return
+	}
+
+	active.spinner.FinalMSG = color.RedString("\u2716" + active.spinner.Suffix + " (interrupted)\n")
+	active.stop()
+	active = nil
+}
+
+// Config controls how an OutputStreamer displays an operation.
+type Config struct {
+	// OutputLines is the number of the latest output lines displayed
+	OutputLines     int
+	SpinnerStyle    Style
+	SpinnerInterval time.Duration
+	NoSpinner       bool
+}
+
 type OutputStreamer struct {
 	spinner *spinner.Spinner
-	lines   []string
+	title   string
+	// static prints status lines instead of animating the spinner, which is
+	// done when asked to or when stdout isn't a terminal
+	static bool
+	// done stops the periodic status lines of a static streamer
+	done  chan struct{}
+	lines []string
+	// maxLines is the number of the latest lines displayed
+	maxLines int
+	// terminal is whether stdout is a terminal the output can be redrawn in
+	terminal bool
+	// rows is the number of terminal rows used by the displayed lines, which
+	// is more than the number of lines when long lines wrap
+	rows int
+	// started is when the operation started, to show how long it took
+	started time.Time
 }
 
-func NewOutputStreamer(title string) *OutputStreamer {
-	s := spinner.New(spinner.CharSets[charSet], 100*time.Millisecond)
+func NewOutputStreamer(title string, config Config) *OutputStreamer {
+	charSet, ok := spinner.CharSets[int(config.SpinnerStyle)]
+	if !ok {
+		charSet = spinner.CharSets[int(DefaultSpinnerStyle)]
+	}
+
+	interval := config.SpinnerInterval
+	if interval <= 0 {
+		interval = DefaultSpinnerInterval
+	}
+
+	s := spinner.New(charSet, interval)
 	s.Suffix = " " + title
+
+	terminal := term.IsTerminal(int(os.Stdout.Fd()))
+	static := config.NoSpinner || !terminal
+
+	// Without a spinner there is nothing to redraw the output lines above
+	maxLines := config.OutputLines
+	if static {
+		maxLines = 0
+	}
+
 	return &OutputStreamer{
-		spinner: s,
-		lines:   make([]string, 0),
+		spinner:  s,
+		title:    title,
+		static:   static,
+		lines:    make([]string, 0),
+		maxLines: maxLines,
+		terminal: terminal,
 	}
 }
 
 func (o *OutputStreamer) start() {
+	o.started = time.Now()
+	if o.static {
+		fmt.Println("\u2022 " + o.title)
+		o.done = make(chan struct{})
+		go o.printStatus()
+		return
+	}
+
 	o.spinner.Start()
 }
 
+// printStatus periodically prints a status line until the operation stops, so
+// long operations don't look stuck without a spinner.
+func (o *OutputStreamer) printStatus() {
+	started := time.Now()
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+			fmt.Printf("\u2022 %s (%s)\n", o.title, time.Since(started).Round(time.Second))
+		}
+	}
+}
+
+// pause stops the spinner so lines can be printed above it.
+func (o *OutputStreamer) pause() {
+	if !o.static {
+		o.spinner.Stop()
+	}
+}
+
+// resume restarts the spinner after pausing it.
+func (o *OutputStreamer) resume() {
+	if !o.static {
+		o.spinner.Start()
+	}
+}
+
 func (o *OutputStreamer) stop() {
+	if o.static {
+		close(o.done)
+		fmt.Print(o.spinner.FinalMSG)
+		return
+	}
+
+	// The output lines are above the spinner, so they have to be cleared
+	// before the final message is printed in the spinner's place
+	finalMsg := o.spinner.FinalMSG
+	o.spinner.FinalMSG = ""
 	o.spinner.Stop()
 	o.clearOutput()
+	o.lines = make([]string, 0)
+	fmt.Print(finalMsg)
 }
 
 func (o *OutputStreamer) pass() {
-	o.spinner.FinalMSG = "\u2714" + o.spinner.Suffix + "\n"
+	o.spinner.FinalMSG = "\u2714" + o.spinner.Suffix + o.elapsed() + "\n"
 	o.stop()
 }
 
 func (o *OutputStreamer) fail() {
-	o.spinner.FinalMSG = color.RedString("\u2716" + o.spinner.Suffix + "\n")
+	o.spinner.FinalMSG = color.RedString("\u2716" + o.spinner.Suffix + o.elapsed() + "\n")
 	o.stop()
 }
 
+// elapsed returns how long the operation took to show after its title, which
+// is only shown in verbose mode.
+func (o *OutputStreamer) elapsed() string {
+	if !Verbose || o.started.IsZero() {
+		return ""
+	}
+
+	return " (" + formatDuration(time.Since(o.started)) + ")"
+}
+
+// formatDuration rounds the duration to keep it short, e.g. 3.2s or 45ms.
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+
+	return d.Round(100 * time.Millisecond).String()
+}
+
 func (o *OutputStreamer) addOutput(line string) {
-	if len(line) > 0 {
+	if len(line) > 0 && o.maxLines > 0 {
 		o.lines = append(o.lines, line)
 		o.updateDisplay()
 	}
 }
 
+// printLine permanently prints a line above the spinner.
+func (o *OutputStreamer) printLine(line string) {
+	o.pause()
+	fmt.Println(color.BlackString("  " + line))
+	o.resume()
+}
+
 func (o *OutputStreamer) clearOutput() {
-	if len(o.lines) > 0 {
-		// Clear the output lines by moving cursor up and clearing lines
-		for i := 0; i < len(o.lines); i++ {
-			fmt.Print("\033[1A\033[K") // Move up and clear line
-		}
-		o.lines = make([]string, 0)
+	// Redirected output is only ever appended to
+	if !o.terminal {
+		return
+	}
+
+	// Clear the output lines by moving cursor up and clearing each row
+	for i := 0; i < o.rows; i++ {
+		fmt.Print("\033[1A\033[K") // Move up and clear line
 	}
+
+	o.rows = 0
 }
 
 func (o *OutputStreamer) updateDisplay() {
+	// The spinner is redrawn below the output lines once they are displayed
+	o.pause()
+	defer o.resume()
+
 	// Clear previous output lines
 	o.clearOutput()
 
 	// Display current output lines
 	displayLines := o.lines
-	if len(displayLines) > maxDisplayLines {
-		displayLines = displayLines[len(displayLines)-maxDisplayLines:]
+	if len(displayLines) > o.maxLines {
+		displayLines = displayLines[len(displayLines)-o.maxLines:]
 	}
 
+	width := terminalWidth()
 	for _, line := range displayLines {
 		if len(line) > 0 {
 			fmt.Println(line)
+			o.rows += displayRows(line, width)
 		}
 	}
 }
 
+// terminalWidth returns the width of the terminal, falling back to a default
+// when stdout isn't a terminal.
+func terminalWidth() int {
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		return defaultWidth
+	}
+
+	return width
+}
+
+// displayRows returns the number of terminal rows the line occupies once it
+// wraps at the given width.
+func displayRows(line string, width int) int {
+	n := utf8.RuneCountInString(line)
+	if n == 0 {
+		return 1
+	}
+
+	return (n + width - 1) / width
+}
+
 func handleCompletion(streamer *OutputStreamer, err error) {
 	if err != nil {
 		streamer.fail()
@@ -94,9 +325,29 @@ func handleCompletion(streamer *OutputStreamer, err error) {
 	}
 }
 
-func Run(title string, operation func(chan<- string) error) {
-	streamer := NewOutputStreamer(title)
+// Run runs the operation behind a spinner, returning the operation's error
+// once it has been displayed.
+func Run(title string, operation func(chan<- string) error) error {
+	// Steps of a progress bar are only displayed when they fail
+	activeMu.Lock()
+	quiet := Quiet || stopped || bar != nil
+	activeMu.Unlock()
+
+	if quiet {
+		return runQuiet(title, operation)
+	}
+
+	emitStart(title)
+	streamer := NewOutputStreamer(title, Config{
+		OutputLines:     OutputLines,
+		SpinnerStyle:    SpinnerStyle,
+		SpinnerInterval: SpinnerInterval,
+		NoSpinner:       NoSpinner,
+	})
+	activeMu.Lock()
+	active = streamer
 	streamer.start()
+	activeMu.Unlock()
 
 	// Create a channel to receive output from the operation
 	outputChan := make(chan string, 100)
@@ -109,35 +360,169 @@ func Run(title string, operation func(chan<- string) error) {
 		close(outputChan)
 	}()
 
-	// Stream output as it comes in
-	for {
-		select {
-		case _, ok := <-outputChan:
-			if !ok {
-				// Channel closed, operation finished
-				err := <-errChan
-				handleCompletion(streamer, err)
-				return
+	// Stream output as it comes in until the operation finishes and closes the
+	// channel
+	for output := range outputChan {
+		emitOutput(title, output)
+
+		// Nothing more is displayed once the streamer has been stopped
+		activeMu.Lock()
+		if active == streamer && Verbose {
+			streamer.printLine(output)
+		} else if active == streamer {
+			streamer.addOutput(output)
+		}
+		activeMu.Unlock()
+	}
+
+	err := <-errChan
+	activeMu.Lock()
+	if active == streamer {
+		handleCompletion(streamer, err)
+		active = nil
+	}
+	activeMu.Unlock()
+
+	emitComplete(title, err)
+	return err
+}
+
+// runQuiet runs the operation without any progress display, discarding its
+// output and only printing the operation if it fails.
+func runQuiet(title string, operation func(chan<- string) error) error {
+	emitStart(title)
+	outputChan := make(chan string, 100)
+	done := make(chan struct{})
+
+	go func() {
+		for output := range outputChan {
+			emitOutput(title, output)
+		}
+
+		close(done)
+	}()
+
+	err := operation(outputChan)
+	close(outputChan)
+	<-done
+	emitComplete(title, err)
+
+	// Failures caused by stopping early aren't worth reporting
+	activeMu.Lock()
+	interrupted := stopped
+	activeMu.Unlock()
+
+	if err != nil && !interrupted {
+		Above(func() {
+			fmt.Fprintln(ErrorOutput, color.RedString("\u2716 "+title))
+			for _, line := range strings.Split(err.Error(), "\n") {
+				fmt.Fprintln(ErrorOutput, color.BlackString("  "+line))
 			}
+		})
+	}
 
-			// streamer.addOutput(output)
-		case err := <-errChan:
-			handleCompletion(streamer, err)
-			return
+	return err
+}
+
+// CommandError is returned when a command exits with a non-zero status,
+// keeping what it wrote to stdout and stderr apart.
+type CommandError struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+func (e *CommandError) Error() string {
+	var parts []string
+	for _, output := range []string{e.Stderr, e.Stdout} {
+		if output != "" {
+			parts = append(parts, output)
 		}
 	}
+
+	parts = append(parts, fmt.Sprintf("exit code %d", e.ExitCode))
+	return strings.Join(parts, "\n")
 }
 
+// commandError wraps a failed command's output in a CommandError, returning
+// errors from commands that never ran as is.
+func commandError(err error, stdout, stderr string) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+
+	return &CommandError{
+		ExitCode: exitErr.ExitCode(),
+		Stdout:   strings.TrimSpace(stdout),
+		Stderr:   strings.TrimSpace(stderr),
+	}
+}
+
+// RunCommand runs the command, streaming each line of its output to be shown
+// while it runs, and capturing it so failures include the full output.
 func RunCommand(cmd *exec.Cmd, outputChan chan<- string) error {
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s", strings.TrimSpace(string(output)))
+	if Verbose {
+		outputChan <- "$ " + strings.Join(cmd.Args, " ")
+	}
+
+	var stdout, stderr strings.Builder
+	if err := streamCommand(cmd, outputChan, &stdout, &stderr); err != nil {
+		return commandError(err, stdout.String(), stderr.String())
 	}
 
 	return nil
 }
 
+// RetryPolicy controls how RunCommandWithRetry handles failed commands.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries allowed after the first attempt
+	MaxRetries int
+	// Backoff returns how long to wait before the given retry attempt
+	Backoff func(attempt int) time.Duration
+	// ShouldRetry reports whether the command output indicates a transient
+	// failure worth retrying
+	ShouldRetry func(output string) bool
+	// Context stops waiting to retry once it is done, when set
+	Context context.Context
+}
+
+// RunCommandWithRetry runs the command built by newCmd, retrying failures the
+// policy considers transient. A fresh command is built for each attempt as an
+// exec.Cmd cannot be started more than once.
+func RunCommandWithRetry(newCmd func() *exec.Cmd, outputChan chan<- string, policy RetryPolicy) error {
+	for attempt := 0; ; attempt++ {
+		err := RunCommand(newCmd(), outputChan)
+		if err == nil || attempt >= policy.MaxRetries || !policy.ShouldRetry(err.Error()) {
+			return err
+		}
+
+		delay := policy.Backoff(attempt)
+		outputChan <- fmt.Sprintf("Retrying in %s (attempt %d of %d)...", delay, attempt+1, policy.MaxRetries)
+
+		// Waiting can take a while, so it mustn't hold up an interrupt
+		ctx := policy.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
 func RunCommandStreaming(cmd *exec.Cmd, outputChan chan<- string) error {
+	return streamCommand(cmd, outputChan, nil, nil)
+}
+
+// streamCommand sends each line of the command's output to the channel as it
+// runs, optionally capturing stdout and stderr as well.
+func streamCommand(cmd *exec.Cmd, outputChan chan<- string, stdoutCapture, stderrCapture *strings.Builder) error {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -152,27 +537,28 @@ func RunCommandStreaming(cmd *exec.Cmd, outputChan chan<- string) error {
 		return err
 	}
 
-	// Stream stdout
-	go func() {
-		scanner := bufio.NewScanner(stdout)
+	// Both pipes must be fully read before calling Wait, which closes them
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	stream := func(pipe io.Reader, capture *strings.Builder) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(pipe)
 		for scanner.Scan() {
 			line := scanner.Text()
-			if len(line) > 0 {
-				outputChan <- line
+			if capture != nil {
+				capture.WriteString(line + "\n")
 			}
-		}
-	}()
 
-	// Stream stderr
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if len(line) > 0 {
+			if len(line) > 0 && !filtered(line) {
 				outputChan <- line
 			}
 		}
-	}()
+	}
+
+	go stream(stdout, stdoutCapture)
+	go stream(stderr, stderrCapture)
 
+	wg.Wait()
 	return cmd.Wait()
 }
@@ -0,0 +1,216 @@
+package streamer
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lockError is what git prints when another process holds a ref's lock.
+const lockError = "error: cannot lock ref 'refs/remotes/origin/main': is at 1111111 but expected 2222222"
+
+// failingCommand returns a newCmd that fails with the message for the given
+// number of attempts, then succeeds, counting each attempt.
+func failingCommand(t *testing.T, failures int, message string, attempts *int) func() *exec.Cmd {
+	t.Helper()
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+
+	return func() *exec.Cmd {
+		*attempts++
+		if *attempts <= failures {
+			return exec.Command("sh", "-c", `echo "$1" >&2; exit 1`, "sh", message)
+		}
+
+		return exec.Command("sh", "-c", "echo done")
+	}
+}
+
+func TestRunCommandWithRetry(t *testing.T) {
+	policy := RetryPolicy{
+		MaxRetries: 2,
+		Backoff:    func(int) time.Duration { return 0 },
+		ShouldRetry: func(output string) bool {
+			return strings.Contains(output, "cannot lock ref")
+		},
+	}
+
+	tests := []struct {
+		name         string
+		failures     int
+		message      string
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "success", failures: 0, wantAttempts: 1},
+		{name: "transient failure then success", failures: 1, message: lockError, wantAttempts: 2},
+		{name: "retries exhausted", failures: 3, message: lockError, wantAttempts: 3, wantErr: true},
+		{name: "permanent failure", failures: 1, message: "fatal: not a git repository", wantAttempts: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int
+			outputChan := make(chan string, 100)
+
+			err := RunCommandWithRetry(failingCommand(t, tt.failures, tt.message, &attempts), outputChan, policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunCommandWithRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var cmdErr *CommandError
+			if err != nil && (!errors.As(err, &cmdErr) || cmdErr.Stderr != tt.message) {
+				t.Errorf("RunCommandWithRetry() error = %v, want the output of the last attempt", err)
+			}
+
+			if attempts != tt.wantAttempts {
+				t.Errorf("RunCommandWithRetry() ran %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+
+			close(outputChan)
+			var retries int
+			for line := range outputChan {
+				if strings.HasPrefix(line, "Retrying in ") {
+					retries++
+				}
+			}
+
+			if retries != tt.wantAttempts-1 {
+				t.Errorf("RunCommandWithRetry() reported %d retries, want %d", retries, tt.wantAttempts-1)
+			}
+		})
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+
+	script := `echo one; echo two >&2; echo three; exit "$1"`
+
+	tests := []struct {
+		name     string
+		verbose  bool
+		exitCode string
+		want     []string
+		wantErr  bool
+	}{
+		{name: "success", exitCode: "0", want: []string{"one", "two", "three"}},
+		{name: "failure", exitCode: "1", want: []string{"one", "two", "three"}, wantErr: true},
+		{name: "verbose", verbose: true, exitCode: "0", want: []string{"$ sh -c " + script + " sh 0", "one", "two", "three"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Verbose = tt.verbose
+			t.Cleanup(func() { Verbose = false })
+
+			outputChan := make(chan string, 100)
+			err := RunCommand(exec.Command("sh", "-c", script, "sh", tt.exitCode), outputChan)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var cmdErr *CommandError
+			if err != nil && (!errors.As(err, &cmdErr) || cmdErr.Stdout != "one\nthree" || cmdErr.Stderr != "two") {
+				t.Errorf("RunCommand() error = %#v, want the captured output", err)
+			}
+
+			close(outputChan)
+			var got []string
+			for line := range outputChan {
+				got = append(got, line)
+			}
+
+			// Stdout and stderr are read separately, so only their own order is kept
+			slices.Sort(got)
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("RunCommand() streamed %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRunCommandOutputFilter(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+
+	script := `echo "From /src/remote"; echo "Receiving objects: 100% (3/3), done." >&2; echo "Fast-forward"; exit "$1"`
+
+	tests := []struct {
+		name   string
+		filter []*regexp.Regexp
+		want   []string
+	}{
+		{name: "default", filter: DefaultOutputFilter, want: []string{"Fast-forward", "From /src/remote"}},
+		{name: "extra pattern", filter: append(slices.Clip(DefaultOutputFilter), regexp.MustCompile("^From ")), want: []string{"Fast-forward"}},
+		{name: "no filter", want: []string{"Fast-forward", "From /src/remote", "Receiving objects: 100% (3/3), done."}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			OutputFilter = tt.filter
+			t.Cleanup(func() { OutputFilter = DefaultOutputFilter })
+
+			outputChan := make(chan string, 100)
+			err := RunCommand(exec.Command("sh", "-c", script, "sh", "1"), outputChan)
+
+			// Hidden lines are still kept for the error
+			var cmdErr *CommandError
+			if !errors.As(err, &cmdErr) || cmdErr.Stderr != "Receiving objects: 100% (3/3), done." {
+				t.Errorf("RunCommand() error = %#v, want the hidden output", err)
+			}
+
+			close(outputChan)
+			var got []string
+			for line := range outputChan {
+				got = append(got, line)
+			}
+
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("RunCommand() streamed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCommandWithRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{
+		MaxRetries:  2,
+		Backoff:     func(int) time.Duration { return time.Minute },
+		ShouldRetry: func(string) bool { return true },
+		Context:     ctx,
+	}
+
+	var attempts int
+	newCmd := failingCommand(t, 1, lockError, &attempts)
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+
+	err := RunCommandWithRetry(newCmd, make(chan string, 100), policy)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("RunCommandWithRetry() error = %v, want %v", err, context.Canceled)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("RunCommandWithRetry() took %s, want it to stop waiting once canceled", elapsed)
+	}
+
+	if attempts != 1 {
+		t.Errorf("RunCommandWithRetry() ran %d attempts, want 1", attempts)
+	}
+}
@@ -0,0 +1,64 @@
+package streamer
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/briandowns/spinner"
+)
+
+// DefaultSpinnerStyle is the braille dots spinner.
+const DefaultSpinnerStyle Style = 14
+
+// styleNames gives memorable names to some of the spinner character sets.
+var styleNames = map[string]Style{
+	"arrows":  0,
+	"circle":  7,
+	"line":    9,
+	"braille": 11,
+	"dots":    14,
+}
+
+// Style is the index of the spinner.CharSets used to draw the spinner. It
+// implements pflag.Value, accepting either an index or one of the style names.
+type Style int
+
+func (s *Style) Set(value string) error {
+	if style, ok := styleNames[value]; ok {
+		*s = style
+		return nil
+	}
+
+	index, err := strconv.Atoi(value)
+	if err != nil {
+		names := make([]string, 0, len(styleNames))
+		for name := range styleNames {
+			names = append(names, name)
+		}
+
+		slices.Sort(names)
+		return fmt.Errorf("unknown spinner style %q, use an index or one of %v", value, names)
+	}
+
+	if _, ok := spinner.CharSets[index]; !ok {
+		return fmt.Errorf("spinner style %d does not exist", index)
+	}
+
+	*s = Style(index)
+	return nil
+}
+
+func (s *Style) String() string {
+	for name, style := range styleNames {
+		if style == *s {
+			return name
+		}
+	}
+
+	return strconv.Itoa(int(*s))
+}
+
+func (s *Style) Type() string {
+	return "style"
+}